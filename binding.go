@@ -0,0 +1,52 @@
+package statesman
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+)
+
+// ErrSessionBindingMismatch is the invalid session reason for a request whose
+// client doesn't match the client that started the session.
+var ErrSessionBindingMismatch = errors.New("Session binding mismatch.")
+
+// Binding selects the attributes of the client that started a session which
+// subsequent requests of the session must match. Bindings can be combined, as
+// in BindRemoteAddr | BindUserAgent.
+type Binding int
+
+const (
+	// Bind sessions to the client's IP address
+	BindRemoteAddr Binding = 1 << iota
+	// Bind sessions to the client's User-Agent header
+	BindUserAgent
+	// Bind sessions to the client's TLS certificate
+	BindClientCert
+
+	allBindings = BindRemoteAddr | BindUserAgent | BindClientCert
+)
+
+// The attributes of a client that a session is bound to
+type fingerprint struct {
+	remoteAddr string
+	userAgent  string
+	clientCert string
+}
+
+// Record the bound attributes of the request's client
+func (binding Binding) fingerprint(r *http.Request) fingerprint {
+	var fp fingerprint
+	if binding&BindRemoteAddr != 0 {
+		// The port differs between connections
+		fp.remoteAddr = RemoteHost(r)
+	}
+	if binding&BindUserAgent != 0 {
+		fp.userAgent = r.UserAgent()
+	}
+	if binding&BindClientCert != 0 && r.TLS != nil && len(r.TLS.PeerCertificates) != 0 {
+		sum := sha256.Sum256(r.TLS.PeerCertificates[0].Raw)
+		fp.clientCert = hex.EncodeToString(sum[:])
+	}
+	return fp
+}
@@ -0,0 +1,83 @@
+package statesman
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"testing"
+)
+
+func TestFingerprint_OnlyRecordsBoundAttributes(t *testing.T) {
+	r := &http.Request{RemoteAddr: "192.0.2.1:1234", Header: http.Header{"User-Agent": {"agent"}}}
+
+	if fp := Binding(0).fingerprint(r); fp != (fingerprint{}) {
+		t.Fatalf("Expected an empty fingerprint got %v\n", fp)
+	}
+	if fp := BindUserAgent.fingerprint(r); fp != (fingerprint{userAgent: "agent"}) {
+		t.Fatalf("Expected only the user agent got %v\n", fp)
+	}
+}
+
+func TestFingerprint_IgnoresRemotePort(t *testing.T) {
+	first := &http.Request{RemoteAddr: "192.0.2.1:1234"}
+	second := &http.Request{RemoteAddr: "192.0.2.1:5678"}
+	other := &http.Request{RemoteAddr: "192.0.2.2:1234"}
+
+	if BindRemoteAddr.fingerprint(first) != BindRemoteAddr.fingerprint(second) {
+		t.Fatalf("The same address on another port should match\n")
+	}
+	if BindRemoteAddr.fingerprint(first) == BindRemoteAddr.fingerprint(other) {
+		t.Fatalf("Another address shouldn't match\n")
+	}
+}
+
+func TestFingerprint_HashesClientCert(t *testing.T) {
+	withCert := func(raw string) *http.Request {
+		cert := &x509.Certificate{Raw: []byte(raw)}
+		return &http.Request{TLS: &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}}
+	}
+
+	if BindClientCert.fingerprint(withCert("a")) != BindClientCert.fingerprint(withCert("a")) {
+		t.Fatalf("The same certificate should match\n")
+	}
+	if BindClientCert.fingerprint(withCert("a")) == BindClientCert.fingerprint(withCert("b")) {
+		t.Fatalf("Another certificate shouldn't match\n")
+	}
+	if BindClientCert.fingerprint(withCert("a")) == BindClientCert.fingerprint(&http.Request{}) {
+		t.Fatalf("A request without a certificate shouldn't match\n")
+	}
+}
+
+func TestSessionHandler_RejectsRequestsFromAnotherClient(t *testing.T) {
+	reasons := make(chan error, 1)
+	crl := newTestController(
+		WithBinding(BindUserAgent),
+		WithInvalidSessionHandler(func(w http.ResponseWriter, r *http.Request) {
+			reasons <- InvalidSessionReason(r)
+			DefaultInvalidSessionHandler(w, r)
+		}),
+	)
+	defer crl.Close()
+	tokens := make(chan string, 1)
+	firstHandler := crl.SessionStart(func(s *Session) {
+		s.First()
+		tokens <- s.Token()
+		s.Next()
+	})
+
+	tc := newTestClient()
+	tc.r.Header.Set("User-Agent", "agent")
+	firstHandler(tc.w, tc.r)
+
+	tc = newTestClient()
+	tc.r.Header.Set("User-Agent", "another agent")
+	tc.r.AddCookie(&http.Cookie{Name: DefaultCookieName, Value: <-tokens})
+	crl.SessionHandler()(tc.w, tc.r)
+
+	if reason := <-reasons; reason != ErrSessionBindingMismatch {
+		t.Fatalf("Expected %v got %v\n", ErrSessionBindingMismatch, reason)
+	}
+	if tc.w.status != http.StatusForbidden {
+		t.Fatalf("Expected the request to be forbidden got %d\n", tc.w.status)
+	}
+}
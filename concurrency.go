@@ -0,0 +1,111 @@
+package statesman
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+// ConcurrencyPolicy decides what happens when a session receives a request
+// while it's still handling another.
+type ConcurrencyPolicy int
+
+const (
+	// QueueRequests handles concurrent requests one after another
+	QueueRequests ConcurrencyPolicy = iota
+	// RejectConcurrentRequests passes a request that arrives while another
+	// is being handled to the conflict handler
+	RejectConcurrentRequests
+	// CancelOlderRequests cancels the context of the request being handled,
+	// or passes a request still waiting to be handled to the conflict
+	// handler, and then handles the new request
+	CancelOlderRequests
+)
+
+// A request was rejected or superseded because of a concurrent request
+var errConcurrentRequest = errors.New("Concurrent request.")
+
+// A request admitted to, or waiting to be admitted to, a session
+type admission struct {
+	cancel context.CancelFunc
+}
+
+// Respond to a request that wasn't admitted to its session for the given
+// reason
+func (clr *Controller) notAdmitted(w http.ResponseWriter, r *http.Request, reason error) {
+	switch reason {
+	case errConcurrentRequest:
+		// A request whose client has gone away doesn't need a response
+		if r.Context().Err() == nil {
+			clr.options.ConflictHandler(w, r)
+		}
+	case context.Canceled, context.DeadlineExceeded:
+	default:
+		clr.invalidSession(w, r, reason)
+	}
+}
+
+// Allow the next request to be admitted
+func (session *Session) release() {
+	<-session.slot
+}
+
+// Admit a request to the session according to the policy, waiting for any
+// request that is already being handled. The returned request must be used in
+// place of r and release called once it has been handled. The error is
+// errConcurrentRequest if the request was rejected or superseded, the reason
+// the session ended, or the request context's error.
+func (session *Session) admit(r *http.Request, policy ConcurrencyPolicy) (*http.Request, func(), error) {
+	switch policy {
+	case RejectConcurrentRequests:
+		select {
+		case session.slot <- struct{}{}:
+			return r, session.release, nil
+		default:
+			return nil, nil, errConcurrentRequest
+		}
+	case CancelOlderRequests:
+		ctx, cancel := context.WithCancel(r.Context())
+		current := &admission{cancel}
+		session.latestMutex.Lock()
+		if session.latest != nil {
+			session.latest.cancel()
+		}
+		session.latest = current
+		session.latestMutex.Unlock()
+
+		forget := func() {
+			session.latestMutex.Lock()
+			if session.latest == current {
+				session.latest = nil
+			}
+			session.latestMutex.Unlock()
+			cancel()
+		}
+		select {
+		case session.slot <- struct{}{}:
+		case <-ctx.Done():
+			forget()
+			if err := r.Context().Err(); err != nil {
+				return nil, nil, err
+			}
+			return nil, nil, errConcurrentRequest
+		case <-session.done:
+			forget()
+			return nil, nil, session.Err()
+		}
+		return r.WithContext(ctx), func() {
+			forget()
+			session.release()
+		}, nil
+	default:
+		select {
+		case session.slot <- struct{}{}:
+			return r, session.release, nil
+		case <-r.Context().Done():
+			return nil, nil, r.Context().Err()
+		case <-session.done:
+			return nil, nil, session.Err()
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package statesman
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Start a session that handles its requests with step and return the request
+// for its next step
+func startConcurrentSession(crl *Controller, step func(w http.ResponseWriter, r *http.Request)) func() *http.Request {
+	cookies := startTestSession(crl, func(s *Session) {
+		s.First()
+		for {
+			w, r := s.Next()
+			if w == nil {
+				return
+			}
+			step(w, r)
+		}
+	})
+
+	return func() *http.Request {
+		r := newTestClient().r
+		for _, cookie := range cookies {
+			r.AddCookie(cookie)
+		}
+		return r
+	}
+}
+
+// Wait for the condition to become true
+func waitFor(t *testing.T, condition func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for condition\n")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSessionHandler_QueuesConcurrentRequests(t *testing.T) {
+	crl := newTestController()
+	defer crl.Close()
+	newRequest := startConcurrentSession(crl, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Response", r.Header.Get("X-Request"))
+		w.WriteHeader(http.StatusOK)
+	})
+
+	var wg sync.WaitGroup
+	writers := make([]*testResponseWriter, 20)
+	for i := range writers {
+		writers[i] = &testResponseWriter{}
+		r := newRequest()
+		r.Header.Set("X-Request", strconv.Itoa(i))
+		wg.Add(1)
+		go func(w *testResponseWriter) {
+			defer wg.Done()
+			crl.SessionHandler()(w, r)
+		}(writers[i])
+	}
+	wg.Wait()
+
+	for i, w := range writers {
+		if w.status != http.StatusOK || w.Header().Get("X-Response") != strconv.Itoa(i) {
+			t.Fatalf("Request %d got the wrong response %d %v\n", i, w.status, w.Header())
+		}
+	}
+}
+
+func TestSessionHandler_RejectsConcurrentRequests(t *testing.T) {
+	crl := newTestController(WithConcurrencyPolicy(RejectConcurrentRequests))
+	defer crl.Close()
+	handling := make(chan bool)
+	hold := make(chan bool)
+	newRequest := startConcurrentSession(crl, func(w http.ResponseWriter, r *http.Request) {
+		handling <- true
+		<-hold
+		w.WriteHeader(http.StatusOK)
+	})
+
+	first := &testResponseWriter{}
+	done := make(chan bool)
+	go func() {
+		crl.SessionHandler()(first, newRequest())
+		done <- true
+	}()
+	<-handling
+
+	second := &testResponseWriter{}
+	crl.SessionHandler()(second, newRequest())
+	if second.status != http.StatusConflict {
+		t.Fatalf("Expected %d got %d\n", http.StatusConflict, second.status)
+	}
+
+	hold <- true
+	<-done
+	if first.status != http.StatusOK {
+		t.Fatalf("Expected the first request to be handled got %d\n", first.status)
+	}
+}
+
+func TestSessionHandler_CancelsOlderRequest(t *testing.T) {
+	crl := newTestController(WithConcurrencyPolicy(CancelOlderRequests))
+	defer crl.Close()
+	handling := make(chan bool, 1)
+	finish := make(chan bool)
+	newRequest := startConcurrentSession(crl, func(w http.ResponseWriter, r *http.Request) {
+		handling <- true
+		select {
+		case <-r.Context().Done():
+			w.WriteHeader(http.StatusGone)
+		case <-finish:
+			w.WriteHeader(http.StatusOK)
+		}
+	})
+
+	first := &testResponseWriter{}
+	done := make(chan bool)
+	go func() {
+		crl.SessionHandler()(first, newRequest())
+		done <- true
+	}()
+	<-handling
+
+	// The second request cancels the first, and is itself cancelled by the
+	// third once the session handles it
+	second := &testResponseWriter{}
+	go func() {
+		crl.SessionHandler()(second, newRequest())
+		done <- true
+	}()
+	<-done
+	if first.status != http.StatusGone {
+		t.Fatalf("Expected the first request to be cancelled got %d\n", first.status)
+	}
+	<-handling
+
+	third := &testResponseWriter{}
+	go func() {
+		crl.SessionHandler()(third, newRequest())
+		done <- true
+	}()
+	<-done
+	<-handling
+	if second.status != http.StatusGone {
+		t.Fatalf("Expected the second request to be cancelled got %d\n", second.status)
+	}
+
+	finish <- true
+	<-done
+	if third.status != http.StatusOK {
+		t.Fatalf("Expected the third request to be handled got %d\n", third.status)
+	}
+}
+
+func TestSessionHandler_CancelsOlderWaitingRequest(t *testing.T) {
+	crl := newTestController(WithConcurrencyPolicy(CancelOlderRequests))
+	defer crl.Close()
+	handling := make(chan bool, 1)
+	hold := make(chan bool)
+	newRequest := startConcurrentSession(crl, func(w http.ResponseWriter, r *http.Request) {
+		handling <- true
+		<-hold
+		w.WriteHeader(http.StatusOK)
+	})
+	session := func() *Session {
+		session, _, _ := (&Workflow{controller: crl}).findSession(newRequest())
+		return session
+	}()
+	latest := func() *admission {
+		session.latestMutex.Lock()
+		defer session.latestMutex.Unlock()
+		return session.latest
+	}
+
+	done := make(chan bool)
+	writers := []*testResponseWriter{{}, {}, {}}
+	for _, w := range writers {
+		previous := latest()
+		go func(w *testResponseWriter) {
+			crl.SessionHandler()(w, newRequest())
+			done <- true
+		}(w)
+		waitFor(t, func() bool { return latest() != previous })
+	}
+	<-handling
+
+	// The second request was waiting when the third arrived
+	<-done
+	if writers[1].status != http.StatusConflict {
+		t.Fatalf("Expected %d got %d\n", http.StatusConflict, writers[1].status)
+	}
+
+	hold <- true
+	<-done
+	<-handling
+	hold <- true
+	<-done
+	if writers[0].status != http.StatusOK || writers[2].status != http.StatusOK {
+		t.Fatalf("Expected the first and third requests to be handled got %d %d\n", writers[0].status, writers[2].status)
+	}
+}
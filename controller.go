@@ -1,189 +1,489 @@
 package statesman
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"time"
 )
 
-// DefaultTimeout is the default session timeout used by DefaultOptions
-var DefaultTimeout time.Duration
+const (
+	// Sessions used to be tracked by a cookie named with this prefix
+	// followed by the session key
+	statesmanPrefix = "Statesman-"
+	// How often Shutdown checks whether the active sessions have finished
+	shutdownPollInterval = 10 * time.Millisecond
+)
 
-// DefaultInvalidSessionHandler is the default function called when a session
-// handler endpoint is called without a valid session.
-var DefaultInvalidSessionHandler func(http.ResponseWriter, *http.Request)
+// ErrControllerClosed is returned by methods called on a closed Controller.
+var ErrControllerClosed = errors.New("Controller is closed.")
 
-// The DefaultOptions that are used when NewController is called with a new
-// Options
-var DefaultOptions Options
+// ErrNoSession is the invalid session reason for a request without a session
+// token.
+var ErrNoSession = errors.New("No session.")
 
-func init() {
-	DefaultTimeout = time.Minute * 10
-	DefaultInvalidSessionHandler = func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusForbidden)
-		w.Write([]byte(fmt.Sprintf("Invalid Session. (%s).", r.URL.Path)))
-	}
-	DefaultOptions = Options{DefaultTimeout, DefaultInvalidSessionHandler}
-}
+// ErrUnknownSession is the invalid session reason for a request whose session
+// doesn't exist, for example because it has already finished.
+var ErrUnknownSession = errors.New("Unknown session.")
 
-const (
-	statesmanPrefix = "Statesman-"
-)
+// ErrSessionKeyRetired is the invalid session reason for a request whose
+// session key was replaced by key rotation longer than the rotation grace ago.
+var ErrSessionKeyRetired = errors.New("Session key retired.")
+
+var errShuttingDown = errors.New("Controller is shutting down.")
+
+// The context key of the reason a request's session was invalid
+type invalidSessionReasonKey struct{}
+
+// InvalidSessionReason returns why the session of a request passed to the
+// invalid session handler was rejected. The reason is one of ErrNoSession,
+// ErrUnknownSession, ErrSessionKeyRetired, ErrTokenInvalid, ErrTokenExpired,
+// ErrSessionBindingMismatch, ErrSessionExpired, ErrSessionAborted or
+// ErrSessionFinished, or an error returned by the SessionTransport. It returns
+// nil for other requests.
+func InvalidSessionReason(r *http.Request) error {
+	reason, _ := r.Context().Value(invalidSessionReasonKey{}).(error)
+	return reason
+}
 
 // Struct for (un-)registering sessions
 type registration struct {
 	sessionKey string
 	session    *Session
 	register   bool
+	// Receives the result of a registration, nil for unregistrations
+	errCh chan error
 }
 
 type sessionRequest struct {
 	sessionKey      string
-	sessionReceiver chan *Session
+	sessionReceiver chan *sessionLookup
+}
+
+// The result of a sessionRequest, the session is nil if there isn't one and
+// err is ErrSessionKeyRetired if the key has been retired.
+type sessionLookup struct {
+	session *Session
+	err     error
+}
+
+// Struct for replacing a session's key with a new one
+type rotation struct {
+	oldKey string
+	newKey string
+	errCh  chan error
+}
+
+// Struct for claiming the name of a workflow
+type workflowClaim struct {
+	name  string
+	errCh chan error
+}
+
+// A key that was replaced by rotation
+type retiredKey struct {
+	session *Session
+	// The key is still accepted until then
+	graceUntil time.Time
 }
 
 // Controller manages a workflow with potentially several client
 // sessions.
 type Controller struct {
-	options          *Options
+	options          Options
+	tokens           *tokenCodec
+	transport        SessionTransport
+	startLimiter     *rateLimiter
 	registrationCh   chan *registration
 	sessionRequestCh chan *sessionRequest
+	rotationCh       chan *rotation
+	workflowCh       chan *workflowClaim
 	sessionCountCh   chan int
+	drainCh          chan int
 	closeCh          chan bool
-	openCh           chan bool
+	// Closed once the controller has been closed
+	closedCh chan struct{}
 }
 
-// Options configures the Controller
-type Options struct {
-	sessionTimeout        time.Duration
-	invalidSessionHandler func(http.ResponseWriter, *http.Request)
+// ShutdownReport describes what happened to the sessions that were active when
+// Controller.Shutdown was called.
+type ShutdownReport struct {
+	// The number of sessions that finished before the shutdown deadline
+	Completed int
+	// The number of sessions that were aborted at the shutdown deadline
+	Terminated int
 }
 
-// NewController constructs a new Controller with the given options.
-func NewController(options *Options) *Controller {
-	if options == nil {
-		options = &DefaultOptions
+// NewController constructs a new Controller from DefaultOptions modified by the
+// given options. An error is returned if any option is invalid.
+func NewController(opts ...Option) (*Controller, error) {
+	options := DefaultOptions
+	for _, opt := range opts {
+		if err := opt(&options); err != nil {
+			return nil, err
+		}
+	}
+	if err := options.validate(); err != nil {
+		return nil, err
+	}
+	tokens, err := newTokenCodec(&options)
+	if err != nil {
+		return nil, err
 	}
-	if options.sessionTimeout == 0 {
-		options.sessionTimeout = DefaultOptions.sessionTimeout
+	transport := options.Transport
+	if transport == nil {
+		// Legacy cookies can't be verified so aren't accepted with verified
+		// tokens
+		transport = &CookieTransport{options.Cookie, options.AcceptLegacyCookies && !tokens.verifies()}
 	}
 
 	controller := Controller{
 		options,
+		tokens,
+		transport,
+		newRateLimiter(options.StartRateLimit),
 		make(chan *registration),
 		make(chan *sessionRequest),
+		make(chan *rotation),
+		make(chan *workflowClaim),
+		make(chan int),
 		make(chan int),
 		make(chan bool),
-		make(chan bool),
+		make(chan struct{}),
 	}
 
 	// Start a service for handling session registrations
 	go func() {
 		sessions := make(map[string]*Session)
+		retired := make(map[string]*retiredKey)
+		// All of the keys, current and retired, of each session
+		keys := make(map[*Session][]string)
+		// The number of active sessions of each client
+		clients := make(map[string]int)
+		// The names of the Controller's workflows
+		workflows := make(map[string]bool)
+		draining := false
+
+		lookup := func(sessionKey string) *sessionLookup {
+			if session, ok := sessions[sessionKey]; ok {
+				return &sessionLookup{session, nil}
+			}
+			if retiredKey, ok := retired[sessionKey]; ok {
+				if time.Now().Before(retiredKey.graceUntil) {
+					return &sessionLookup{retiredKey.session, nil}
+				}
+				return &sessionLookup{nil, ErrSessionKeyRetired}
+			}
+			return &sessionLookup{}
+		}
+
 		for {
 			select {
 			case registration := <-controller.registrationCh:
 				// (un-)registration
 				if registration.register {
-					sessions[registration.sessionKey] = registration.session
+					session := registration.session
+					if draining {
+						registration.errCh <- errShuttingDown
+						break
+					}
+					if max := controller.options.MaxSessions; max != 0 && len(keys) >= max {
+						registration.errCh <- ErrTooManySessions
+						break
+					}
+					if max := controller.options.MaxSessionsPerClient; max != 0 && session != nil {
+						if clients[session.client] >= max {
+							registration.errCh <- ErrTooManyClientSessions
+							break
+						}
+						clients[session.client]++
+					}
+					sessions[registration.sessionKey] = session
+					keys[session] = append(keys[session], registration.sessionKey)
+					registration.errCh <- nil
 				} else {
-					delete(sessions, registration.sessionKey)
+					// Any of the session's keys unregisters all of them
+					session, ok := sessions[registration.sessionKey]
+					if retiredKey, isRetired := retired[registration.sessionKey]; isRetired {
+						session, ok = retiredKey.session, true
+					}
+					if !ok {
+						break
+					}
+					for _, sessionKey := range keys[session] {
+						delete(sessions, sessionKey)
+						delete(retired, sessionKey)
+					}
+					delete(keys, session)
+					if controller.options.MaxSessionsPerClient != 0 && session != nil {
+						clients[session.client]--
+						if clients[session.client] == 0 {
+							delete(clients, session.client)
+						}
+					}
 				}
 			case sessionRequest := <-controller.sessionRequestCh:
 				// get the session
-				session := sessions[sessionRequest.sessionKey]
-				sessionRequest.sessionReceiver <- session
-			case controller.sessionCountCh <- len(sessions):
+				sessionRequest.sessionReceiver <- lookup(sessionRequest.sessionKey)
+			case rotation := <-controller.rotationCh:
+				// replace the session's key
+				found := lookup(rotation.oldKey)
+				if found.session == nil {
+					if found.err == nil {
+						found.err = ErrUnknownSession
+					}
+					rotation.errCh <- found.err
+					break
+				}
+				// Retire all of the session's live keys, not only the old
+				// key, which may itself be a retired key during its grace
+				session := found.session
+				now := time.Now()
+				for _, sessionKey := range keys[session] {
+					if _, ok := sessions[sessionKey]; ok {
+						delete(sessions, sessionKey)
+						retired[sessionKey] = &retiredKey{session, now.Add(controller.options.RotationGrace)}
+					}
+				}
+				// Forget the keys whose grace has passed except for the
+				// newest, so that the previous key is reported as retired,
+				// and the first, which the session is unregistered with
+				newestExpired := -1
+				for i, sessionKey := range keys[session] {
+					if !now.Before(retired[sessionKey].graceUntil) {
+						newestExpired = i
+					}
+				}
+				kept := keys[session][:1]
+				for i, sessionKey := range keys[session][1:] {
+					if i+1 != newestExpired && !now.Before(retired[sessionKey].graceUntil) {
+						delete(retired, sessionKey)
+						continue
+					}
+					kept = append(kept, sessionKey)
+				}
+				sessions[rotation.newKey] = session
+				keys[session] = append(kept, rotation.newKey)
+				rotation.errCh <- nil
+			case claim := <-controller.workflowCh:
+				// claim a workflow's name
+				if workflows[claim.name] {
+					claim.errCh <- fmt.Errorf("Duplicate workflow name \"%s\".", claim.name)
+					break
+				}
+				workflows[claim.name] = true
+				claim.errCh <- nil
+			case controller.sessionCountCh <- len(keys):
 				// get the session count
+			case controller.drainCh <- len(keys):
+				// stop registering new sessions
+				draining = true
 			case <-controller.closeCh:
-				// close the controller
-				close(controller.openCh)
+				// close the controller and abort its sessions
+				close(controller.closedCh)
+				for session := range keys {
+					if session != nil {
+						session.end(ErrSessionAborted)
+					}
+				}
 				return
-			case controller.openCh <- true:
-				// is open
 			}
 		}
 	}()
-	return &controller
+	return &controller, nil
 }
 
-func (clr *Controller) panicIfClosed() {
-	if !<-clr.openCh {
-		panic("Controller is closed.")
+func (clr *Controller) isClosed() bool {
+	select {
+	case <-clr.closedCh:
+		return true
+	default:
+		return false
 	}
 }
 
-// Close closes the controller. Methods called on a closed controller will
-// panic.
+// Close closes the controller and aborts all of its sessions. Closing an
+// already closed controller returns ErrControllerClosed.
 func (clr *Controller) Close() error {
-	clr.panicIfClosed()
-	clr.closeCh <- true
-	return nil
-
+	select {
+	case clr.closeCh <- true:
+		return nil
+	case <-clr.closedCh:
+		return ErrControllerClosed
+	}
 }
 
-func (clr *Controller) register(sessionKey string, session *Session) {
-	clr.panicIfClosed()
-	clr.registrationCh <- &registration{sessionKey, session, true}
+func (clr *Controller) register(sessionKey string, session *Session) error {
+	errCh := make(chan error)
+	select {
+	case clr.registrationCh <- &registration{sessionKey, session, true, errCh}:
+		return <-errCh
+	case <-clr.closedCh:
+		return ErrControllerClosed
+	}
 }
 
+// Sessions unregister themselves when they finish, which may be after the
+// controller has been closed, so unregistering a closed controller is a no-op.
 func (clr *Controller) unregister(sessionKey string) {
-	clr.panicIfClosed()
-	clr.registrationCh <- &registration{sessionKey, nil, false}
+	select {
+	case clr.registrationCh <- &registration{sessionKey, nil, false, nil}:
+	case <-clr.closedCh:
+	}
 }
 
-func (clr *Controller) session(sessionKey string) *Session {
-	clr.panicIfClosed()
+// Return the session registered under the key, nil if there isn't one. A
+// retired key whose grace has passed returns ErrSessionKeyRetired.
+func (clr *Controller) session(sessionKey string) (*Session, error) {
+	sessionReceiver := make(chan *sessionLookup)
+	select {
+	case clr.sessionRequestCh <- &sessionRequest{sessionKey, sessionReceiver}:
+		found := <-sessionReceiver
+		return found.session, found.err
+	case <-clr.closedCh:
+		return nil, ErrControllerClosed
+	}
+}
 
-	sessionReceiver := make(chan *Session)
-	clr.sessionRequestCh <- &sessionRequest{sessionKey, sessionReceiver}
+// Replace the session's key with a new one, retiring the old key
+func (clr *Controller) rotate(sessionKey string) (string, error) {
+	newKey := generateUniqueString(32)
+	errCh := make(chan error)
+	select {
+	case clr.rotationCh <- &rotation{sessionKey, newKey, errCh}:
+		if err := <-errCh; err != nil {
+			return "", err
+		}
+		return newKey, nil
+	case <-clr.closedCh:
+		return "", ErrControllerClosed
+	}
+}
 
-	return <-sessionReceiver
+// Claim the name of a new workflow, which fails if another workflow has it
+func (clr *Controller) claimWorkflow(name string) error {
+	errCh := make(chan error)
+	select {
+	case clr.workflowCh <- &workflowClaim{name, errCh}:
+		return <-errCh
+	case <-clr.closedCh:
+		return ErrControllerClosed
+	}
 }
 
+// A closed controller has no sessions
 func (clr *Controller) sessionCount() int {
-	clr.panicIfClosed()
-	return <-clr.sessionCountCh
+	select {
+	case count := <-clr.sessionCountCh:
+		return count
+	case <-clr.closedCh:
+		return 0
+	}
 }
 
-// SessionStart returns a handler function to initiate the session handler. The
-// Controller.First() method can be called to get the http.ResponseWriter and
-// http.Request. The returned handler function can be used with http.HandleFunc
-func (clr *Controller) SessionStart(sessionHandler func(s *Session)) func(w http.ResponseWriter, r *http.Request) {
-	clr.panicIfClosed()
-	sessionInitializer := func(w http.ResponseWriter, r *http.Request) {
-
-		session := Session{make(chan bool), make(chan *httpRequest), clr}
+// Shutdown gracefully shuts down the controller. New sessions are refused
+// while the active sessions are given until ctx is done to finish their
+// workflows, after which the controller is closed and any remaining sessions
+// are aborted. If ctx is done before all sessions finish Shutdown returns the
+// context's error.
+func (clr *Controller) Shutdown(ctx context.Context) (ShutdownReport, error) {
+	var active int
+	select {
+	case active = <-clr.drainCh:
+	case <-clr.closedCh:
+		return ShutdownReport{}, ErrControllerClosed
+	}
 
-		// Create a session and register it with the session controller
-		sessionKey := statesmanPrefix + generateUniqueString(32)
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+
+	remaining := active
+	for remaining != 0 {
+		select {
+		case <-ctx.Done():
+			remaining = clr.sessionCount()
+			clr.Close()
+			return ShutdownReport{Completed: active - remaining, Terminated: remaining}, ctx.Err()
+		case <-ticker.C:
+			remaining = clr.sessionCount()
+		}
+	}
 
-		// Register the session with the controller
-		clr.register(sessionKey, &session)
+	clr.Close()
+	return ShutdownReport{Completed: active}, nil
+}
 
-		go func() {
-			sessionHandler(&session)
+// Mint the CSRF token of a step, empty without CSRF protection
+func (clr *Controller) csrfToken() string {
+	if !clr.options.CSRFProtection {
+		return ""
+	}
+	return generateUniqueString(32)
+}
 
-			// The request has been serviced so allow the previous handler
-			// function to finish
-			session.unblockHandler()
+// Respond to a request whose session is invalid for the given reason
+func (clr *Controller) invalidSession(w http.ResponseWriter, r *http.Request, reason error) {
+	ctx := context.WithValue(r.Context(), invalidSessionReasonKey{}, reason)
+	clr.options.InvalidSessionHandler(w, r.WithContext(ctx))
+}
 
-			// Unregister the session from the controller
-			clr.unregister(sessionKey)
-		}()
+// Report a panic in a session function and respond to the request the session
+// was handling, if any.
+func (clr *Controller) recoverSession(session *Session, value interface{}, stack []byte) {
+	session.endPanicked()
+	clr.options.PanicHandler(value, stack)
+	if session.current != nil {
+		clr.options.ErrorHandler(session.current.w, session.current.r)
+	}
+}
 
-		// Set the session cookie before passing the response onto the session
-		// to avoid a race condition with the session goroutine
-		http.SetCookie(w, generateSessionCookie(sessionKey, "", clr.options.sessionTimeout))
+// Respond to a request that was sent to a session that ended before receiving
+// it. The request failed if the session panicked, otherwise its session is
+// invalid.
+func (clr *Controller) sessionEnded(w http.ResponseWriter, r *http.Request, session *Session) {
+	if session.panicked {
+		clr.options.ErrorHandler(w, r)
+		return
+	}
+	clr.invalidSession(w, r, session.Err())
+}
 
-		// Send the initial request to the session (received via First()).
-		session.httpRequestCh <- &httpRequest{w, r}
+// Return a workflow with the default routes and past step policy
+func (clr *Controller) workflow(name string, sessionHandler func(s *Session)) *Workflow {
+	return &Workflow{
+		controller:     clr,
+		name:           name,
+		sessionHandler: sessionHandler,
+		prefix:         "/",
+		startPath:      DefaultStartPath,
+		pastSteps:      clr.options.PastSteps,
+	}
+}
 
-		// Wait for the session to handle the request before returning from this HandleFunc
-		session.blockHandler()
+// NewSessionStart is like SessionStart but returns ErrControllerClosed if the
+// controller has been closed.
+func (clr *Controller) NewSessionStart(sessionHandler func(s *Session)) (func(w http.ResponseWriter, r *http.Request), error) {
+	if clr.isClosed() {
+		return nil, ErrControllerClosed
 	}
+	return clr.SessionStart(sessionHandler), nil
+}
+
+// SessionStart returns a handler function to initiate the session handler. The
+// Controller.First() method can be called to get the http.ResponseWriter and
+// http.Request. The returned handler function can be used with http.HandleFunc
+func (clr *Controller) SessionStart(sessionHandler func(s *Session)) func(w http.ResponseWriter, r *http.Request) {
+	return clr.workflow("", sessionHandler).SessionStart()
+}
 
-	return sessionInitializer
+// NewSessionHandler is like SessionHandler but returns ErrControllerClosed if
+// the controller has been closed.
+func (clr *Controller) NewSessionHandler() (func(w http.ResponseWriter, r *http.Request), error) {
+	if clr.isClosed() {
+		return nil, ErrControllerClosed
+	}
+	return clr.SessionHandler(), nil
 }
 
 // SessionHandler returns a handler function to process within the session
@@ -191,32 +491,5 @@ func (clr *Controller) SessionStart(sessionHandler func(s *Session)) func(w http
 // http.ResponseWriter and http.Request. The returned handler function can be
 // used with http.HandleFunc
 func (clr *Controller) SessionHandler() func(w http.ResponseWriter, r *http.Request) {
-	clr.panicIfClosed()
-	nextHandler := func(w http.ResponseWriter, r *http.Request) {
-		cookie, err := findSessionCookie(r.Cookies())
-		// Matching session cookie doesn't exist
-		if err != nil {
-			clr.options.invalidSessionHandler(w, r)
-			return
-		}
-		sessionKey := cookie.Name
-
-		// Session doesn't exist or has already exited
-		session := clr.session(sessionKey)
-		if session == nil {
-			clr.options.invalidSessionHandler(w, r)
-			return
-		}
-
-		// Set the session cookie before passing the response onto the session
-		// to avoid a race condition with the session goroutine
-		http.SetCookie(w, generateSessionCookie(sessionKey, "", clr.options.sessionTimeout))
-
-		// Send this request to the session (received via Next().
-		session.httpRequestCh <- &httpRequest{w, r}
-
-		// Block this handler until the session has serviced the current request
-		session.blockHandler()
-	}
-	return nextHandler
+	return clr.workflow("", nil).SessionHandler()
 }
@@ -1,79 +1,142 @@
 package statesman
 
 import (
+	"context"
 	"net/http"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
 
-func TestNewController_AcceptsNilOptions(t *testing.T) {
-	crl := NewController(nil)
-	if crl.options != &DefaultOptions {
-		t.Fatalf("Nil options didn't use default options\n")
+func newTestController(opts ...Option) *Controller {
+	crl, err := NewController(opts...)
+	assertNoError(err)
+	return crl
+}
+
+func TestNewController_UsesDefaultOptions(t *testing.T) {
+	crl, err := NewController()
+	if err != nil {
+		t.Fatalf("NewController shouldn't have returned an err %v\n", err)
+	}
+	if crl.options.SessionTimeout != DefaultTimeout {
+		t.Fatalf("NewController didn't use the default options\n")
 	}
 }
 
-func TestNewController_AcceptsDefaultOptions(t *testing.T) {
-	crl := NewController(&DefaultOptions)
-	if crl.options != &DefaultOptions {
-		t.Fatalf("DefaultOptions didn't get set\n")
+func TestNewController_AppliesOptions(t *testing.T) {
+	timeout := time.Minute * 20
+	crl, err := NewController(WithSessionTimeout(timeout))
+	if err != nil {
+		t.Fatalf("NewController shouldn't have returned an err %v\n", err)
+	}
+	if crl.options.SessionTimeout != timeout {
+		t.Fatalf("NewController didn't apply the session timeout\n")
+	}
+	if DefaultOptions.SessionTimeout != DefaultTimeout {
+		t.Fatalf("NewController modified DefaultOptions\n")
 	}
 }
 
 func TestControllerClose_ShutsDownControllerService(t *testing.T) {
-	crl := NewController(nil)
+	crl := newTestController()
 	err := crl.Close()
 	if err != nil {
 		t.Fatalf("Closing session shouldn't have returned an err %v\n", err)
 	}
 }
 
-func TestControllerClose_MethodsPanicIfClosed(t *testing.T) {
-	crl := NewController(nil)
+func TestControllerClose_MethodsReturnErrorsIfClosed(t *testing.T) {
+	crl := newTestController()
 	crl.Close()
-	funcs := []func(){
-		func() { crl.Close() },
-		func() { crl.register("", nil) },
-		func() { crl.unregister("") },
-		func() { crl.session("") },
-		func() { crl.sessionCount() },
-		func() { crl.SessionStart(func(*Session) {}) },
-		func() { crl.SessionHandler() },
-	}
-
-	expectedError := "Controller is closed."
-	for _, fn := range funcs {
-		func() {
-			defer func() {
-				if r := recover(); r != expectedError {
-					t.Fatalf("register should panic with \"%s\", got \"%s\"\n", expectedError, r)
-				}
-			}()
-			fn()
-		}()
+	_, shutdownErr := crl.Shutdown(context.Background())
+	_, sessionErr := crl.session("")
+	_, sessionStartErr := crl.NewSessionStart(func(*Session) {})
+	_, sessionHandlerErr := crl.NewSessionHandler()
+
+	errs := []error{
+		crl.Close(),
+		crl.register("", nil),
+		shutdownErr,
+		sessionErr,
+		sessionStartErr,
+		sessionHandlerErr,
+	}
+
+	for _, err := range errs {
+		if err != ErrControllerClosed {
+			t.Fatalf("Expected ErrControllerClosed got %v\n", err)
+		}
+	}
+	if 0 != crl.sessionCount() {
+		t.Fatalf("A closed controller shouldn't have sessions\n")
+	}
+}
+
+func TestControllerClose_HandlersReturnServiceUnavailableIfClosed(t *testing.T) {
+	crl := newTestController()
+	firstHandler := crl.SessionStart(func(s *Session) { s.First() })
+	nextHandler := crl.SessionHandler()
+	crl.Close()
+
+	tc := newTestClient()
+	<-tc.get(firstHandler)
+	if tc.w.status != http.StatusServiceUnavailable {
+		t.Fatalf("SessionStart should have returned StatusServiceUnavailable\n")
 	}
+
+	tc = newTestClient()
+	<-tc.get(nextHandler)
+	if tc.w.status != http.StatusServiceUnavailable {
+		t.Fatalf("SessionHandler should have returned StatusServiceUnavailable\n")
+	}
+}
+
+func TestControllerClose_UnregisterDoesNotPanicIfClosed(t *testing.T) {
+	crl := newTestController()
+	crl.Close()
+	crl.unregister("")
+}
+
+func TestControllerClose_AbortsSessions(t *testing.T) {
+	crl := newTestController()
+	sessionFinished := make(chan bool)
+	handler := crl.SessionStart(func(s *Session) {
+		defer func() { sessionFinished <- true }()
+		s.First()
+		crl.Close()
+		_, _, err := s.NextContext(context.Background())
+		if err != ErrSessionAborted {
+			t.Fatalf("Expected ErrSessionAborted got %v\n", err)
+		}
+		if s.Context().Err() != context.Canceled {
+			t.Fatalf("Session context wasn't cancelled\n")
+		}
+	})
+
+	tc := newTestClient()
+	<-tc.get(handler)
+	<-sessionFinished
 }
 
 func TestSession_ReturnsARegisteredSession(t *testing.T) {
-	crl := NewController(nil)
+	crl := newTestController()
 	defer crl.Close()
 
 	sessionKey := "some session key"
-	handlerGuard := make(chan bool)
-
-	session := &Session{handlerGuard: handlerGuard}
+	session := &Session{}
 
 	crl.register(sessionKey, session)
 
-	if session != crl.session(sessionKey) {
+	if found, _ := crl.session(sessionKey); session != found {
 		t.Fatalf("Expected to get session got %v\n", session)
 	}
 }
 
 func TestRegister_IncrementsTheSessionCount(t *testing.T) {
 	sessionKey := "some session"
-	crl := NewController(nil)
+	crl := newTestController()
 	before := crl.sessionCount()
 	crl.register(sessionKey, nil)
 	if before != crl.sessionCount()-1 {
@@ -83,7 +146,7 @@ func TestRegister_IncrementsTheSessionCount(t *testing.T) {
 
 func TestUnregister_DecrementsTheSessionCount(t *testing.T) {
 	sessionKey := "some session"
-	crl := NewController(nil)
+	crl := newTestController()
 	crl.register(sessionKey, nil)
 	before := crl.sessionCount()
 	crl.unregister(sessionKey)
@@ -93,7 +156,7 @@ func TestUnregister_DecrementsTheSessionCount(t *testing.T) {
 }
 
 func TestSessionStart_HandlerRegistersThenUnregistersNewSession(t *testing.T) {
-	crl := NewController(nil)
+	crl := newTestController()
 	sessionFinished := make(chan bool)
 	handler := crl.SessionStart(func(s *Session) {
 		defer func() { sessionFinished <- true }()
@@ -121,7 +184,7 @@ func TestSessionStart_HandlerRegistersThenUnregistersNewSession(t *testing.T) {
 }
 
 func TestSessionStart_CallsSessionFunction(t *testing.T) {
-	crl := NewController(nil)
+	crl := newTestController()
 	sessionCalled := make(chan bool)
 	handler := crl.SessionStart(func(s *Session) {
 		defer func() { sessionCalled <- true }()
@@ -138,16 +201,15 @@ func TestSessionStart_CallsSessionFunction(t *testing.T) {
 
 func TestSessionStart_SetsSessionCookieWithCorrectExpiration(t *testing.T) {
 	timeout := time.Minute * 20
-	options := &Options{timeout, DefaultInvalidSessionHandler}
-	crl := NewController(options)
+	crl := newTestController(WithSessionTimeout(timeout), WithInvalidSessionHandler(DefaultInvalidSessionHandler))
 	sessionFinished := make(chan bool)
 	handler := crl.SessionStart(func(s *Session) {
 		defer func() { sessionFinished <- true }()
 		w, _ := s.First()
-		if !strings.HasPrefix(w.Header()["Set-Cookie"][0], statesmanPrefix) {
+		if !strings.HasPrefix(w.Header()["Set-Cookie"][0], DefaultCookieName+"=") {
 			t.Fatalf("SessionStart didn't set cookie\n")
 		}
-		expectedTime := time.Now().Add(timeout).UTC().Format(time.RFC1123)
+		expectedTime := time.Now().Add(timeout).UTC().Format(http.TimeFormat)
 		if !strings.Contains(w.Header()["Set-Cookie"][0], expectedTime) {
 			t.Fatalf("SessionStart didn't set correct timeout\n")
 		}
@@ -160,14 +222,14 @@ func TestSessionStart_SetsSessionCookieWithCorrectExpiration(t *testing.T) {
 }
 
 func TestSessionStart_SendsRequestToSession(t *testing.T) {
-	crl := NewController(nil)
+	crl := newTestController()
 	tc := newTestClient()
 	sessionFinished := make(chan bool)
 	handler := crl.SessionStart(func(s *Session) {
 		defer func() { sessionFinished <- true }()
 		w, r := s.First()
 
-		if w != tc.w {
+		if w.(*responseWriter).Unwrap() != tc.w {
 			t.Fatalf("Got unexpected ResponseWriter\n")
 		}
 		if r != tc.r {
@@ -181,7 +243,7 @@ func TestSessionStart_SendsRequestToSession(t *testing.T) {
 }
 
 func TestSessionStart_BlocksHandlerFunctionUntilSessionFinishes(t *testing.T) {
-	crl := NewController(nil)
+	crl := newTestController()
 	finishedFirst := make(chan string)
 	handler := crl.SessionStart(func(s *Session) {
 		s.First()
@@ -204,7 +266,7 @@ func TestSessionStart_BlocksHandlerFunctionUntilSessionFinishes(t *testing.T) {
 }
 
 func TestSessionHandler_ReturnsForbiddenIfHandlerCalledWithoutSession(t *testing.T) {
-	crl := NewController(nil)
+	crl := newTestController()
 	handler := crl.SessionHandler()
 	tc := newTestClient()
 	<-tc.get(handler)
@@ -220,7 +282,7 @@ func TestSessionHandler_CallsCustomInvalidSessionHandler(t *testing.T) {
 		go func() { customInvalidSessionCalledCh <- true }()
 		DefaultInvalidSessionHandler(w, r)
 	}
-	crl := NewController(&Options{DefaultTimeout, customHandler})
+	crl := newTestController(WithSessionTimeout(DefaultTimeout), WithInvalidSessionHandler(customHandler))
 	handler := crl.SessionHandler()
 	tc := newTestClient()
 	<-tc.get(handler)
@@ -232,17 +294,16 @@ func TestSessionHandler_CallsCustomInvalidSessionHandler(t *testing.T) {
 
 func TestSessionHandler_SetsSessionCookieWithCorrectExpiration(t *testing.T) {
 	timeout := time.Minute * 20
-	options := &Options{timeout, DefaultInvalidSessionHandler}
-	crl := NewController(options)
+	crl := newTestController(WithSessionTimeout(timeout), WithInvalidSessionHandler(DefaultInvalidSessionHandler))
 	sessionFinished := make(chan bool)
 	firstHandler := crl.SessionStart(func(s *Session) {
 		defer func() { sessionFinished <- true }()
 		_, _ = s.First()
 		w, _ := s.Next()
-		if !strings.HasPrefix(w.Header()["Set-Cookie"][0], statesmanPrefix) {
+		if !strings.HasPrefix(w.Header()["Set-Cookie"][0], DefaultCookieName+"=") {
 			t.Fatalf("SessionStart didn't set cookie\n")
 		}
-		expectedTime := time.Now().Add(timeout).UTC().Format(time.RFC1123)
+		expectedTime := time.Now().Add(timeout).UTC().Format(http.TimeFormat)
 		if !strings.Contains(w.Header()["Set-Cookie"][0], expectedTime) {
 			t.Fatalf("SessionStart didn't set correct timeout\n")
 		}
@@ -264,13 +325,12 @@ func TestSessionHandler_CallsCustomInvalidSessionHandlerIfSessionNotStarted(t *t
 		go func() { customInvalidSessionCalledCh <- true }()
 		DefaultInvalidSessionHandler(w, r)
 	}
-	crl := NewController(&Options{DefaultTimeout, customHandler})
+	crl := newTestController(WithSessionTimeout(DefaultTimeout), WithInvalidSessionHandler(customHandler))
 	nextHandler := crl.SessionHandler()
 
 	go func() {
 		tc := newTestClient()
-		sessionKey := statesmanPrefix + generateUniqueString(32)
-		tc.r.AddCookie(generateSessionCookie(sessionKey, "", crl.options.sessionTimeout))
+		tc.r.AddCookie(generateSessionCookie(DefaultCookieName, generateUniqueString(32), crl.options.SessionTimeout, crl.options.Cookie))
 		tc.get(nextHandler)
 	}()
 
@@ -280,13 +340,13 @@ func TestSessionHandler_CallsCustomInvalidSessionHandlerIfSessionNotStarted(t *t
 }
 
 func TestSessionHandler_SendsRequestToSession(t *testing.T) {
-	crl := NewController(nil)
+	crl := newTestController()
 	tc := newTestClient()
 	sessionFinished := make(chan bool)
 	firstHandler := crl.SessionStart(func(s *Session) {
 		defer func() { sessionFinished <- true }()
 		w, r := s.First()
-		if w != tc.w {
+		if w.(*responseWriter).Unwrap() != tc.w {
 			t.Fatalf("Got unexpected ResponseWriter\n")
 		}
 		if r != tc.r {
@@ -295,7 +355,7 @@ func TestSessionHandler_SendsRequestToSession(t *testing.T) {
 
 		w, r = s.Next()
 
-		if w != tc.w {
+		if w.(*responseWriter).Unwrap() != tc.w {
 			t.Fatalf("Got unexpected ResponseWriter\n")
 		}
 		if r != tc.r {
@@ -313,7 +373,7 @@ func TestSessionHandler_SendsRequestToSession(t *testing.T) {
 }
 
 func TestSessionHandler_BlocksHandlerFunctionUntilSessionFinishes(t *testing.T) {
-	crl := NewController(nil)
+	crl := newTestController()
 	finishedFirst := make(chan string)
 	firstHandler := crl.SessionStart(func(s *Session) {
 		s.First()
@@ -337,3 +397,513 @@ func TestSessionHandler_BlocksHandlerFunctionUntilSessionFinishes(t *testing.T)
 		t.Fatalf("Handler should have finished second\n")
 	}
 }
+
+func TestSessionHandler_ExpiresIdleSession(t *testing.T) {
+	timeout := 10 * time.Millisecond
+	crl := newTestController(WithSessionTimeout(timeout), WithInvalidSessionHandler(DefaultInvalidSessionHandler))
+	sessionFinished := make(chan bool)
+	firstHandler := crl.SessionStart(func(s *Session) {
+		defer func() { sessionFinished <- true }()
+		s.First()
+		w, r := s.Next()
+		if w != nil || r != nil {
+			t.Fatalf("Expired session shouldn't receive a request\n")
+		}
+		if s.Err() != ErrSessionExpired {
+			t.Fatalf("Expected ErrSessionExpired got %v\n", s.Err())
+		}
+	})
+
+	tc := newTestClient()
+	<-tc.get(firstHandler)
+	<-sessionFinished
+
+	if 0 != crl.sessionCount() {
+		t.Fatalf("Expired session wasn't unregistered\n")
+	}
+
+	<-tc.get(crl.SessionHandler())
+	if tc.w.status != http.StatusForbidden {
+		t.Fatalf("Expired session should have gotten StatusForbidden\n")
+	}
+}
+
+// A context that reports when Shutdown first waits on it, which is after it
+// has started draining the controller
+type drainingContext struct {
+	context.Context
+	once    sync.Once
+	waiting chan bool
+}
+
+func (ctx *drainingContext) Done() <-chan struct{} {
+	ctx.once.Do(func() { close(ctx.waiting) })
+	return ctx.Context.Done()
+}
+
+func TestShutdown_WaitsForSessionsToComplete(t *testing.T) {
+	crl := newTestController()
+	ctx := &drainingContext{Context: context.Background(), waiting: make(chan bool)}
+	firstHandler := crl.SessionStart(func(s *Session) {
+		s.First()
+		s.Next()
+	})
+
+	tc := newTestClient()
+	<-tc.get(firstHandler)
+
+	go func() {
+		<-ctx.waiting
+		<-tc.get(crl.SessionHandler())
+	}()
+
+	reportCh := make(chan ShutdownReport)
+	errCh := make(chan error)
+	go func() {
+		report, err := crl.Shutdown(ctx)
+		reportCh <- report
+		errCh <- err
+	}()
+
+	report := <-reportCh
+	if err := <-errCh; err != nil {
+		t.Fatalf("Shutdown shouldn't have returned an err %v\n", err)
+	}
+	if report.Completed != 1 || report.Terminated != 0 {
+		t.Fatalf("Expected 1 completed session got %+v\n", report)
+	}
+}
+
+func TestShutdown_AbortsSessionsAfterDeadline(t *testing.T) {
+	crl := newTestController()
+	sessionErr := make(chan error)
+	firstHandler := crl.SessionStart(func(s *Session) {
+		s.First()
+		_, _, err := s.NextContext(context.Background())
+		sessionErr <- err
+	})
+
+	tc := newTestClient()
+	<-tc.get(firstHandler)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	report, err := crl.Shutdown(ctx)
+
+	if err != context.DeadlineExceeded {
+		t.Fatalf("Expected context.DeadlineExceeded got %v\n", err)
+	}
+	if report.Completed != 0 || report.Terminated != 1 {
+		t.Fatalf("Expected 1 terminated session got %+v\n", report)
+	}
+	if err := <-sessionErr; err != ErrSessionAborted {
+		t.Fatalf("Expected ErrSessionAborted got %v\n", err)
+	}
+}
+
+func TestSessionStart_RefusesNewSessionsWhileShuttingDown(t *testing.T) {
+	crl := newTestController()
+	firstHandler := crl.SessionStart(func(s *Session) {
+		s.First()
+	})
+
+	// Start draining the controller as Shutdown does
+	<-crl.drainCh
+
+	tc := newTestClient()
+	<-tc.get(firstHandler)
+	if tc.w.status != http.StatusServiceUnavailable {
+		t.Fatalf("SessionStart should have returned StatusServiceUnavailable\n")
+	}
+}
+
+func TestSessionStart_RecoversPanicsInSessionFunction(t *testing.T) {
+	panicValues := make(chan interface{}, 1)
+	crl := newTestController(WithPanicHandler(func(value interface{}, stack []byte) {
+		if len(stack) == 0 {
+			t.Errorf("Panic handler didn't get a stack trace\n")
+		}
+		panicValues <- value
+	}))
+	firstHandler := crl.SessionStart(func(s *Session) {
+		s.First()
+		s.Next()
+		panic("boom")
+	})
+	nextHandler := crl.SessionHandler()
+
+	tc := newTestClient()
+	<-tc.get(firstHandler)
+	<-tc.get(nextHandler)
+
+	if tc.w.status != http.StatusInternalServerError {
+		t.Fatalf("Panicking session should have returned StatusInternalServerError\n")
+	}
+	if value := <-panicValues; value != "boom" {
+		t.Fatalf("Expected panic value \"boom\" got %v\n", value)
+	}
+
+	// There's a race condition so busy wait until the session has been
+	// unregistered
+	for i := 0; i != 100 && crl.sessionCount() != 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if 0 != crl.sessionCount() {
+		t.Fatalf("Panicking session wasn't unregistered\n")
+	}
+}
+
+func TestSessionStart_PanicBeforeFirstIsAnError(t *testing.T) {
+	crl := newTestController(WithPanicHandler(func(value interface{}, stack []byte) {}))
+	defer crl.Close()
+	firstHandler := crl.SessionStart(func(s *Session) {
+		panic("boom")
+	})
+
+	tc := newTestClient()
+	<-tc.get(firstHandler)
+	if tc.w.status != http.StatusInternalServerError {
+		t.Fatalf("Expected StatusInternalServerError got %d\n", tc.w.status)
+	}
+}
+
+func TestSessionStart_PanicAfterAbortIsInvalidSession(t *testing.T) {
+	crl := newTestController(WithPanicHandler(func(value interface{}, stack []byte) {}))
+	defer crl.Close()
+	firstHandler := crl.SessionStart(func(s *Session) {
+		s.Abort()
+		panic("boom")
+	})
+
+	tc := newTestClient()
+	<-tc.get(firstHandler)
+	if tc.w.status != http.StatusForbidden {
+		t.Fatalf("Expected StatusForbidden got %d\n", tc.w.status)
+	}
+}
+
+func TestSessionHandler_AcceptsAndReplacesLegacyCookie(t *testing.T) {
+	crl := newTestController()
+	sessionFinished := make(chan bool)
+	setCookies := make(chan []string, 1)
+	firstHandler := crl.SessionStart(func(s *Session) {
+		defer func() { sessionFinished <- true }()
+		s.First()
+		w, _ := s.Next()
+		setCookies <- w.Header()["Set-Cookie"]
+	})
+
+	tc := newTestClient()
+	<-tc.get(firstHandler)
+	sessionKey := tc.w.Header().Get("Set-Cookie")
+	sessionKey = strings.TrimPrefix(strings.Split(sessionKey, ";")[0], DefaultCookieName+"=")
+
+	// Replay the request with the session key in a legacy cookie
+	tc.init()
+	tc.r.AddCookie(&http.Cookie{Name: statesmanPrefix + sessionKey})
+	handler := crl.SessionHandler()
+	done := make(chan bool)
+	go func() {
+		handler(tc.w, tc.r)
+		done <- true
+	}()
+	<-sessionFinished
+	<-done
+
+	cookies := <-setCookies
+	if len(cookies) != 2 {
+		t.Fatalf("Expected the legacy cookie to be replaced got %v\n", cookies)
+	}
+	if !strings.HasPrefix(cookies[0], statesmanPrefix+sessionKey+"=;") || !strings.Contains(cookies[0], "Max-Age=0") {
+		t.Fatalf("Legacy cookie wasn't removed got %v\n", cookies[0])
+	}
+	if !strings.HasPrefix(cookies[1], DefaultCookieName+"="+sessionKey) {
+		t.Fatalf("Session cookie wasn't set got %v\n", cookies[1])
+	}
+}
+
+func TestSessionHandler_RejectsLegacyCookieIfDisabled(t *testing.T) {
+	crl := newTestController(WithLegacyCookies(false))
+	firstHandler := crl.SessionStart(func(s *Session) {
+		s.First()
+		s.Next()
+	})
+
+	tc := newTestClient()
+	<-tc.get(firstHandler)
+	sessionKey := tc.w.Header().Get("Set-Cookie")
+	sessionKey = strings.TrimPrefix(strings.Split(sessionKey, ";")[0], DefaultCookieName+"=")
+
+	tc.init()
+	tc.r.AddCookie(&http.Cookie{Name: statesmanPrefix + sessionKey})
+	crl.SessionHandler()(tc.w, tc.r)
+
+	if tc.w.status != http.StatusForbidden {
+		t.Fatalf("Legacy cookie should have been rejected\n")
+	}
+}
+
+func TestSessionHandler_ReportsInvalidSessionReason(t *testing.T) {
+	reasons := make(chan error, 1)
+	crl := newTestController(
+		WithSigningKeys(testSigningKey0),
+		WithInvalidSessionHandler(func(w http.ResponseWriter, r *http.Request) {
+			reasons <- InvalidSessionReason(r)
+			DefaultInvalidSessionHandler(w, r)
+		}),
+	)
+	nextHandler := crl.SessionHandler()
+
+	cookies := map[string]error{
+		"":       ErrNoSession,
+		"forged": ErrTokenInvalid,
+		crl.tokens.encode(generateUniqueString(32)): ErrUnknownSession,
+	}
+	for value, expected := range cookies {
+		tc := newTestClient()
+		if value != "" {
+			tc.r.AddCookie(&http.Cookie{Name: DefaultCookieName, Value: value})
+		}
+		nextHandler(tc.w, tc.r)
+		if reason := <-reasons; reason != expected {
+			t.Fatalf("Expected %v got %v\n", expected, reason)
+		}
+	}
+}
+
+func TestSessionHandler_AcceptsSignedTokens(t *testing.T) {
+	crl := newTestController(WithSigningKeys(testSigningKey0), WithEncryptionKeys(testEncryptionKey0))
+	sessionFinished := make(chan bool)
+	firstHandler := crl.SessionStart(func(s *Session) {
+		defer func() { sessionFinished <- true }()
+		s.First()
+		w, _ := s.Next()
+		w.WriteHeader(http.StatusOK)
+	})
+
+	tc := newTestClient()
+	<-tc.get(firstHandler)
+	done := tc.get(crl.SessionHandler())
+	<-sessionFinished
+	<-done
+
+	if tc.w.status != http.StatusOK {
+		t.Fatalf("Signed session token wasn't accepted\n")
+	}
+}
+
+func TestRotate_RetiresTheOldKey(t *testing.T) {
+	crl := newTestController(WithKeyRotation(0))
+	defer crl.Close()
+	session := &Session{}
+	crl.register("old", session)
+
+	newKey, err := crl.rotate("old")
+	if err != nil {
+		t.Fatalf("Unexpected error %v\n", err)
+	}
+	if found, _ := crl.session(newKey); found != session {
+		t.Fatalf("Expected the session under the new key got %v\n", found)
+	}
+	if found, err := crl.session("old"); found != nil || err != ErrSessionKeyRetired {
+		t.Fatalf("Expected the old key to be retired got %v, %v\n", found, err)
+	}
+	if _, err := crl.rotate("old"); err != ErrSessionKeyRetired {
+		t.Fatalf("Expected a retired key not to rotate got %v\n", err)
+	}
+	if count := crl.sessionCount(); count != 1 {
+		t.Fatalf("Expected one session got %d\n", count)
+	}
+
+	crl.unregister("old")
+	if found, err := crl.session(newKey); found != nil || err != nil {
+		t.Fatalf("Unregistering should remove all of the session's keys\n")
+	}
+}
+
+func TestRotate_AcceptsRetiredKeyDuringGrace(t *testing.T) {
+	crl := newTestController(WithKeyRotation(time.Hour))
+	defer crl.Close()
+	session := &Session{}
+	crl.register("old", session)
+	crl.rotate("old")
+
+	if found, err := crl.session("old"); found != session || err != nil {
+		t.Fatalf("Expected the retired key to be accepted got %v, %v\n", found, err)
+	}
+}
+
+func TestRotate_RetiresLiveKeyWhenRotatingDuringGrace(t *testing.T) {
+	crl := newTestController(WithKeyRotation(20 * time.Millisecond))
+	defer crl.Close()
+	session := &Session{}
+	crl.register("first", session)
+	second, _ := crl.rotate("first")
+	// A retry with the first key during its grace
+	third, _ := crl.rotate("first")
+
+	time.Sleep(30 * time.Millisecond)
+	if found, err := crl.session(second); found != nil || err != ErrSessionKeyRetired {
+		t.Fatalf("Expected the second key to be retired got %v, %v\n", found, err)
+	}
+	if found, _ := crl.session(third); found != session {
+		t.Fatalf("Expected the session under the third key got %v\n", found)
+	}
+}
+
+func TestRotate_ForgetsExpiredKeys(t *testing.T) {
+	crl := newTestController(WithKeyRotation(0))
+	defer crl.Close()
+	session := &Session{}
+	crl.register("first", session)
+	second, _ := crl.rotate("first")
+	key := second
+	for i := 0; i < 3; i++ {
+		key, _ = crl.rotate(key)
+	}
+
+	if found, err := crl.session(second); found != nil || err != nil {
+		t.Fatalf("Expected an old key to be forgotten got %v, %v\n", found, err)
+	}
+	crl.unregister("first")
+	if count := crl.sessionCount(); count != 0 {
+		t.Fatalf("Expected the first key to unregister the session got %d sessions\n", count)
+	}
+}
+
+func TestSessionHandler_RotatesSessionKey(t *testing.T) {
+	reasons := make(chan error, 1)
+	crl := newTestController(
+		WithKeyRotation(0),
+		WithInvalidSessionHandler(func(w http.ResponseWriter, r *http.Request) {
+			reasons <- InvalidSessionReason(r)
+			DefaultInvalidSessionHandler(w, r)
+		}),
+	)
+	sessionFinished := make(chan bool)
+	tokens := make(chan string, 2)
+	firstHandler := crl.SessionStart(func(s *Session) {
+		defer func() { sessionFinished <- true }()
+		s.First()
+		tokens <- s.Token()
+		s.Next()
+		tokens <- s.Token()
+		s.Next()
+	})
+
+	tc := newTestClient()
+	<-tc.get(firstHandler)
+	<-tc.get(crl.SessionHandler())
+	first, second := <-tokens, <-tokens
+	if first == second {
+		t.Fatalf("Expected a new token for each step\n")
+	}
+
+	// Replay the second step's request
+	tc = newTestClient()
+	tc.r.AddCookie(&http.Cookie{Name: DefaultCookieName, Value: first})
+	crl.SessionHandler()(tc.w, tc.r)
+	if reason := <-reasons; reason != ErrSessionKeyRetired {
+		t.Fatalf("Expected %v got %v\n", ErrSessionKeyRetired, reason)
+	}
+	crl.Close()
+	<-sessionFinished
+}
+
+func TestSessionStart_ReturnsIfSessionFunctionDoesNotCallFirst(t *testing.T) {
+	reasons := make(chan error, 1)
+	crl := newTestController(WithInvalidSessionHandler(func(w http.ResponseWriter, r *http.Request) {
+		reasons <- InvalidSessionReason(r)
+	}))
+	defer crl.Close()
+	firstHandler := crl.SessionStart(func(s *Session) {})
+
+	tc := newTestClient()
+	firstHandler(tc.w, tc.r)
+
+	if reason := <-reasons; reason != ErrSessionFinished {
+		t.Fatalf("Expected %v got %v\n", ErrSessionFinished, reason)
+	}
+}
+
+func TestSessionHandler_FailsFastAfterSessionFunctionReturns(t *testing.T) {
+	reasons := make(chan error, 1)
+	crl := newTestController(WithInvalidSessionHandler(func(w http.ResponseWriter, r *http.Request) {
+		reasons <- InvalidSessionReason(r)
+	}))
+	defer crl.Close()
+	sessions := make(chan *Session, 1)
+	firstHandler := crl.SessionStart(func(s *Session) {
+		s.First()
+		sessions <- s
+	})
+	tc := newTestClient()
+	firstHandler(tc.w, tc.r)
+	session := <-sessions
+	<-session.done
+
+	if err := session.Err(); err != ErrSessionFinished {
+		t.Fatalf("Expected %v got %v\n", ErrSessionFinished, err)
+	}
+
+	// A request that found the session before it was unregistered
+	crl.register("late", session)
+	tc = newTestClient()
+	tc.r.AddCookie(&http.Cookie{Name: DefaultCookieName, Value: "late"})
+	crl.SessionHandler()(tc.w, tc.r)
+
+	if reason := <-reasons; reason != ErrSessionFinished {
+		t.Fatalf("Expected %v got %v\n", ErrSessionFinished, reason)
+	}
+}
+
+func TestSessionHandler_RequestsRacingSessionEndReturn(t *testing.T) {
+	crl := newTestController(WithInvalidSessionHandler(func(w http.ResponseWriter, r *http.Request) {
+		if reason := InvalidSessionReason(r); reason != ErrSessionFinished && reason != ErrUnknownSession {
+			panic(reason)
+		}
+		DefaultInvalidSessionHandler(w, r)
+	}))
+	defer crl.Close()
+
+	for i := 0; i < 50; i++ {
+		tokens := make(chan string, 1)
+		firstHandler := crl.SessionStart(func(s *Session) {
+			s.First()
+			tokens <- s.Token()
+			w, _ := s.Next()
+			w.WriteHeader(http.StatusOK)
+		})
+		tc := newTestClient()
+		firstHandler(tc.w, tc.r)
+		token := <-tokens
+
+		var wg sync.WaitGroup
+		handled := make(chan int, 10)
+		for j := 0; j < 10; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				w := &testResponseWriter{}
+				r := newTestClient().r
+				r.AddCookie(&http.Cookie{Name: DefaultCookieName, Value: token})
+				crl.SessionHandler()(w, r)
+				handled <- w.status
+			}()
+		}
+		wg.Wait()
+		close(handled)
+
+		ok := 0
+		for status := range handled {
+			if status == http.StatusOK {
+				ok++
+			} else if status != http.StatusForbidden {
+				t.Fatalf("Unexpected status %d\n", status)
+			}
+		}
+		if ok != 1 {
+			t.Fatalf("Expected the session to handle one request got %d\n", ok)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package statesman
+
+import (
+	"crypto/subtle"
+	"net/http"
+)
+
+const (
+	// CSRFHeader is the request header that may carry the CSRF token
+	CSRFHeader = "X-CSRF-Token"
+	// CSRFField is the form field that may carry the CSRF token
+	CSRFField = "statesman_csrf"
+)
+
+// Requests with these methods don't change state so aren't verified
+func isSafeMethod(method string) bool {
+	switch method {
+	case "", http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
+
+// Return the CSRF token carried by the request, from the CSRFHeader header or
+// else the CSRFField form field.
+func requestCSRFToken(r *http.Request) string {
+	if token := r.Header.Get(CSRFHeader); token != "" {
+		return token
+	}
+	return r.PostFormValue(CSRFField)
+}
+
+// Whether the request carries the CSRF token issued with the session's current
+// step. Requests with safe methods always pass.
+func (session *Session) verifyCSRF(r *http.Request) bool {
+	if isSafeMethod(r.Method) {
+		return true
+	}
+	session.csrfMutex.Lock()
+	expected := session.csrfToken
+	session.csrfMutex.Unlock()
+	return verifyCSRFToken(r, expected)
+}
+
+// Whether the request carries the expected CSRF token
+func verifyCSRFToken(r *http.Request, expected string) bool {
+	token := requestCSRFToken(r)
+	return expected != "" && subtle.ConstantTimeCompare([]byte(token), []byte(expected)) == 1
+}
+
+// Make the CSRF token of the step being received the current one
+func (session *Session) setCSRFToken(token string) {
+	session.csrfMutex.Lock()
+	session.csrfToken = token
+	session.csrfMutex.Unlock()
+}
+
+// CSRFToken returns the anti-forgery token of the current step. When CSRF
+// protection is enabled the next request of the session must carry it in the
+// CSRFHeader header or the CSRFField form field unless its method is safe,
+// such as GET. Embed it in the step's forms, for example as
+// <input type="hidden" name="statesman_csrf" value="...">.
+func (session *Session) CSRFToken() string {
+	session.csrfMutex.Lock()
+	defer session.csrfMutex.Unlock()
+	return session.csrfToken
+}
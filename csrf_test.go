@@ -0,0 +1,98 @@
+package statesman
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestIsSafeMethod_OnlyAcceptsSafeMethods(t *testing.T) {
+	for _, method := range []string{"", http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace} {
+		if !isSafeMethod(method) {
+			t.Fatalf("Expected %s to be safe\n", method)
+		}
+	}
+	for _, method := range []string{http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete} {
+		if isSafeMethod(method) {
+			t.Fatalf("Expected %s to be unsafe\n", method)
+		}
+	}
+}
+
+func TestWithCSRFProtection_RequiresFailureHandler(t *testing.T) {
+	if _, err := NewController(WithCSRFProtection(), WithCSRFFailureHandler(nil)); err == nil {
+		t.Fatalf("NewController should have returned an err\n")
+	}
+}
+
+// Start a CSRF protected session whose steps report their CSRF token
+func startCSRFSession(opts ...Option) (*Controller, string, chan string) {
+	crl := newTestController(append([]Option{WithCSRFProtection()}, opts...)...)
+	csrfTokens := make(chan string, 1)
+	cookies := startTestSession(crl, func(s *Session) {
+		w, _ := s.First()
+		for w != nil {
+			csrfTokens <- s.CSRFToken()
+			w, _ = s.Next()
+		}
+	})
+	return crl, cookies[0].Value, csrfTokens
+}
+
+func newCSRFRequest(method string, token string) *http.Request {
+	r := &http.Request{Method: method, URL: &url.URL{}, Header: http.Header{}}
+	r.AddCookie(&http.Cookie{Name: DefaultCookieName, Value: token})
+	return r
+}
+
+func TestSessionHandler_RejectsUnsafeRequestsWithoutCSRFToken(t *testing.T) {
+	failures := make(chan bool, 1)
+	crl, token, csrfTokens := startCSRFSession(WithCSRFFailureHandler(func(w http.ResponseWriter, r *http.Request) {
+		failures <- true
+		DefaultCSRFFailureHandler(w, r)
+	}))
+	defer crl.Close()
+	<-csrfTokens
+
+	for _, csrfToken := range []string{"", "forged"} {
+		w := &testResponseWriter{}
+		r := newCSRFRequest(http.MethodPost, token)
+		r.Header.Set(CSRFHeader, csrfToken)
+		crl.SessionHandler()(w, r)
+
+		<-failures
+		if w.status != http.StatusForbidden {
+			t.Fatalf("Expected the request to be forbidden got %d\n", w.status)
+		}
+	}
+}
+
+func TestSessionHandler_AcceptsCSRFTokenOfCurrentStep(t *testing.T) {
+	crl, token, csrfTokens := startCSRFSession()
+	defer crl.Close()
+	first := <-csrfTokens
+
+	// Safe requests don't need a CSRF token
+	crl.SessionHandler()(&testResponseWriter{}, newCSRFRequest(http.MethodGet, token))
+	second := <-csrfTokens
+	if first == "" || first == second {
+		t.Fatalf("Expected a new CSRF token for each step\n")
+	}
+
+	// The previous step's token is no longer accepted
+	w := &testResponseWriter{}
+	r := newCSRFRequest(http.MethodPost, token)
+	r.Header.Set(CSRFHeader, first)
+	crl.SessionHandler()(w, r)
+	if w.status != http.StatusForbidden {
+		t.Fatalf("Expected the previous step's token to be rejected got %d\n", w.status)
+	}
+
+	r = newCSRFRequest(http.MethodPost, token)
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Body = ioutil.NopCloser(strings.NewReader(url.Values{CSRFField: {second}}.Encode()))
+	crl.SessionHandler()(&testResponseWriter{}, r)
+	<-csrfTokens
+}
@@ -71,7 +71,7 @@ func Test_executeSessionWithFirstNextData(t *testing.T) {
 		}
 		fmt.Fprintf(w, closeData)
 	}
-	sc := NewController(&DefaultOptions)
+	sc := newTestController(WithOptions(DefaultOptions))
 	mux := http.NewServeMux()
 	mux.HandleFunc(firstPath, sc.SessionStart(sessionHandler))
 	mux.HandleFunc(nextPath, sc.SessionHandler())
@@ -113,7 +113,7 @@ func Test_executeSessionWithMultipleClients(t *testing.T) {
 		}
 		fmt.Fprintf(w, "%d", <-counterCh)
 	}
-	sc := NewController(&DefaultOptions)
+	sc := newTestController(WithOptions(DefaultOptions))
 	mux := http.NewServeMux()
 	mux.HandleFunc(firstPath, sc.SessionStart(sessionHandler))
 	mux.HandleFunc(closePath, sc.SessionHandler())
@@ -150,7 +150,7 @@ func Benchmark_Controller(b *testing.B) {
 			}
 		}
 	}
-	sc := NewController(nil)
+	sc := newTestController()
 	mux := http.NewServeMux()
 	mux.HandleFunc(firstPath, sc.SessionStart(sessionHandler))
 	mux.HandleFunc(loopPath, sc.SessionHandler())
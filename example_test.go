@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"time"
 
 	"github.com/efarrer/statesman"
 )
@@ -21,6 +22,10 @@ func countingHandler(session *statesman.Session) {
 	count := 0
 	for {
 		w, r := session.Next()
+		if r == nil {
+			// The session expired
+			return
+		}
 		if r.URL.Path == COUNT {
 			fmt.Fprintf(w, fmt.Sprintf("%d", count))
 			count++
@@ -32,7 +37,10 @@ func countingHandler(session *statesman.Session) {
 }
 
 func ExampleController() {
-	sessionController := statesman.NewController(nil)
+	sessionController, err := statesman.NewController(statesman.WithSessionTimeout(5 * time.Minute))
+	if err != nil {
+		log.Fatal(err)
+	}
 	http.HandleFunc(START, sessionController.SessionStart(countingHandler))
 	http.HandleFunc(COUNT, sessionController.SessionHandler())
 	http.HandleFunc(QUIT, sessionController.SessionHandler())
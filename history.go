@@ -0,0 +1,294 @@
+package statesman
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	// StepHeader is the request header that may carry the step token
+	StepHeader = "Statesman-Step"
+	// StepField is the query parameter or form field that may carry the step
+	// token
+	StepField = "statesman_step"
+	// DefaultMaxHistory is the number of steps a session's history keeps
+	// unless the MaxHistory option is set
+	DefaultMaxHistory = 32
+)
+
+// PastStepPolicy decides what happens to a request from the page of a past
+// step of a session, such as one resubmitted with the browser's back button.
+// Requests are from the page of a step when they carry its step token, see
+// Session.StepToken.
+type PastStepPolicy int
+
+const (
+	// ContinuePastSteps passes requests for past steps to the session like
+	// any other request. Step history isn't kept.
+	ContinuePastSteps PastStepPolicy = iota
+	// ReplayPastSteps answers requests for past steps with the response the
+	// session gave the first time, without passing them to the session.
+	// Responses are kept as long as their steps are in the history and are
+	// replayed without their cookies.
+	ReplayPastSteps
+	// RewindPastSteps discards the history after the latest checkpoint at
+	// or before the past step and passes the request to the session, whose
+	// Rewound method reports the checkpoint to resume from. Requests for
+	// steps before the first checkpoint are rejected.
+	RewindPastSteps
+	// RejectPastSteps answers requests for past steps with the out of
+	// sequence handler.
+	RejectPastSteps
+)
+
+// A response recorded for replaying
+type cachedResponse struct {
+	status int
+	header http.Header
+	body   []byte
+}
+
+// Write the response to w, calling issue to add the current session token
+// to its headers
+func (response *cachedResponse) replay(w http.ResponseWriter, issue func() error) error {
+	for name, values := range response.header {
+		w.Header()[name] = values
+	}
+	if err := issue(); err != nil {
+		return err
+	}
+	w.WriteHeader(response.status)
+	w.Write(response.body)
+	return nil
+}
+
+// A step of a session's history
+type stepRecord struct {
+	token string
+	// The CSRF token issued with the step
+	csrfToken  string
+	checkpoint bool
+	// The response that served the step, nil unless it's being replayed
+	response *cachedResponse
+}
+
+// Return the step token carried by the request, from the StepHeader header or
+// else the StepField query parameter or form field.
+func requestStepToken(r *http.Request) string {
+	if token := r.Header.Get(StepHeader); token != "" {
+		return token
+	}
+	return r.FormValue(StepField)
+}
+
+// How a request is handled by the workflow's PastStepPolicy
+type pastStep struct {
+	// The request is out of sequence
+	rejected bool
+	// The response to replay instead of passing the request to the session
+	response *cachedResponse
+	// The checkpoint to rewind the session to and the CSRF token issued with
+	// the past step
+	rewind    bool
+	rewindTo  int
+	csrfToken string
+}
+
+// Decide how the policy handles the request. The history is only read under
+// one lock, once the request has been admitted, so that the decision isn't
+// made stale by the requests before it.
+func (session *Session) pastStep(r *http.Request, policy PastStepPolicy) pastStep {
+	session.historyMutex.Lock()
+	defer session.historyMutex.Unlock()
+
+	step, ok := session.requestStep(r)
+	if !ok {
+		return pastStep{rejected: true}
+	}
+	if step == -1 || step == session.firstStep+len(session.history)-1 {
+		return pastStep{}
+	}
+
+	switch policy {
+	case ReplayPastSteps:
+		if i := step + 1 - session.firstStep; i < len(session.history) && session.history[i].response != nil {
+			return pastStep{response: session.history[i].response}
+		}
+	case RewindPastSteps:
+		if rewindTo := session.checkpointBefore(step); rewindTo != -1 {
+			csrfToken := session.history[step-session.firstStep].csrfToken
+			return pastStep{rewind: true, rewindTo: rewindTo, csrfToken: csrfToken}
+		}
+	}
+	return pastStep{rejected: true}
+}
+
+// Find the step of the history whose token the request carries. It returns -1
+// if the request doesn't carry a step token and false if the token isn't one
+// of the session's. The historyMutex must be held.
+func (session *Session) requestStep(r *http.Request) (int, bool) {
+	token := requestStepToken(r)
+	if token == "" {
+		return -1, true
+	}
+
+	i := strings.IndexByte(token, '.')
+	if i == -1 {
+		return -1, false
+	}
+	step, err := strconv.Atoi(token[:i])
+	if err != nil {
+		return -1, false
+	}
+	if step < session.firstStep || step >= session.firstStep+len(session.history) {
+		return -1, false
+	}
+	if session.history[step-session.firstStep].token != token {
+		return -1, false
+	}
+	return step, true
+}
+
+// Return the latest checkpoint at or before the step in the history, or -1 if
+// there isn't one. The historyMutex must be held.
+func (session *Session) checkpointBefore(step int) int {
+	for i := step - session.firstStep; i >= 0; i-- {
+		if session.history[i].checkpoint {
+			return session.firstStep + i
+		}
+	}
+	return -1
+}
+
+// Add a step for the request to the history, first discarding the steps after
+// the checkpoint the request rewinds to. It returns false without adding a
+// step if the checkpoint is no longer in the history.
+func (session *Session) addStep(request *httpRequest) bool {
+	session.historyMutex.Lock()
+	defer session.historyMutex.Unlock()
+
+	next := session.firstStep + len(session.history)
+	if request.rewind && (request.rewindTo < session.firstStep || request.rewindTo >= next) {
+		return false
+	}
+	session.rewound = request.rewind
+	session.rewoundTo = request.rewindTo
+	if request.rewind {
+		session.history = session.history[:request.rewindTo+1-session.firstStep]
+		next = request.rewindTo + 1
+	}
+	if !session.keepHistory && len(session.history) != 0 {
+		session.history = session.history[:0]
+		session.firstStep = next
+	}
+	request.step = next
+	session.history = append(session.history, &stepRecord{
+		token:     fmt.Sprintf("%d.%s", next, generateUniqueString(8)),
+		csrfToken: request.csrfToken,
+	})
+
+	// Forget the oldest steps, and their responses, beyond the maximum
+	if excess := len(session.history) - session.maxHistory; excess > 0 {
+		copy(session.history, session.history[excess:])
+		for i := len(session.history) - excess; i < len(session.history); i++ {
+			session.history[i] = nil
+		}
+		session.history = session.history[:len(session.history)-excess]
+		session.firstStep += excess
+	}
+	return true
+}
+
+// Record the response to the current request if it's to be replayed. Only
+// the responses of accepted requests are recorded, so a request answered out
+// of sequence only replaces the session token that the last request's
+// response is replayed with.
+func (session *Session) recordResponse() {
+	current := session.current
+	writer, ok := current.w.(*responseWriter)
+	if !ok || !writer.recording {
+		return
+	}
+
+	session.historyMutex.Lock()
+	defer session.historyMutex.Unlock()
+	if current.step == -1 {
+		if session.last != nil {
+			last := *session.last
+			last.token = current.token
+			session.last = &last
+		}
+		return
+	}
+	response := writer.recorded()
+	if i := current.step - session.firstStep; i >= 0 && i < len(session.history) {
+		session.history[i].response = response
+	}
+	session.last = &handledRequest{current.method, current.path, current.stepToken, current.idempotencyKey, current.token, response}
+}
+
+// Step returns the number of the current step. The request that started the
+// session is step 0 and each request passed to the session is the next step.
+func (session *Session) Step() int {
+	session.historyMutex.Lock()
+	defer session.historyMutex.Unlock()
+	return session.firstStep + len(session.history) - 1
+}
+
+// StepToken returns the token of the current step. Requests that carry it in
+// the StepHeader header or the StepField query parameter or form field are
+// from the current step's page, so a request that carries an earlier step's
+// token is handled by the workflow's PastStepPolicy. Embed it in the step's
+// forms and links.
+func (session *Session) StepToken() string {
+	session.historyMutex.Lock()
+	defer session.historyMutex.Unlock()
+	if len(session.history) == 0 {
+		return ""
+	}
+	return session.history[len(session.history)-1].token
+}
+
+// Checkpoint marks the current step as one that RewindPastSteps can rewind
+// the session to.
+func (session *Session) Checkpoint() {
+	session.historyMutex.Lock()
+	defer session.historyMutex.Unlock()
+	if len(session.history) != 0 {
+		session.history[len(session.history)-1].checkpoint = true
+	}
+}
+
+// Rewound returns the checkpoint that the current request rewound the session
+// to, and false if it didn't rewind the session. The session function should
+// resume from the checkpoint's step.
+func (session *Session) Rewound() (int, bool) {
+	session.historyMutex.Lock()
+	defer session.historyMutex.Unlock()
+	return session.rewoundTo, session.rewound
+}
+
+// Start recording the response
+func (rw *responseWriter) record() {
+	rw.recording = true
+	rw.status = http.StatusOK
+}
+
+// Return the recorded response without its cookies
+func (rw *responseWriter) recorded() *cachedResponse {
+	rw.mutex.Lock()
+	defer rw.mutex.Unlock()
+	header := http.Header{}
+	source := rw.header
+	if !rw.detached {
+		source = rw.w.Header()
+	}
+	for name, values := range source {
+		if name != "Set-Cookie" {
+			header[name] = append([]string(nil), values...)
+		}
+	}
+	return &cachedResponse{rw.status, header, append([]byte(nil), rw.body.Bytes()...)}
+}
@@ -0,0 +1,234 @@
+package statesman
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Return a session function whose steps call step and then respond with their
+// number and step token
+func respondWithSteps(step func(s *Session)) func(s *Session) {
+	return func(s *Session) {
+		w, _ := s.First()
+		for w != nil {
+			step(s)
+			w.Header().Set(StepHeader, s.StepToken())
+			w.WriteHeader(http.StatusCreated)
+			fmt.Fprintf(w, "step %d", s.Step())
+			w, _ = s.Next()
+		}
+	}
+}
+
+// Start a session that responds with its steps and return a function that
+// sends a request carrying a step token to it
+func startHistorySession(crl *Controller, step func(s *Session)) func(stepToken string) *httptest.ResponseRecorder {
+	cookies := startTestSession(crl, respondWithSteps(step))
+	return func(stepToken string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set(StepHeader, stepToken)
+		return sendTestRequest(crl, r, cookies)
+	}
+}
+
+func TestStepToken_NumbersSteps(t *testing.T) {
+	crl := newTestController()
+	defer crl.Close()
+	stepTokens := make(chan string, 1)
+	send := startHistorySession(crl, func(s *Session) {
+		stepTokens <- s.StepToken()
+	})
+
+	for i := 0; i < 3; i++ {
+		token := <-stepTokens
+		if !strings.HasPrefix(token, fmt.Sprintf("%d.", i)) {
+			t.Fatalf("Expected a token for step %d got %s\n", i, token)
+		}
+		send(token)
+	}
+}
+
+func TestReplayPastSteps_ReplaysCachedResponse(t *testing.T) {
+	crl := newTestController(WithPastStepPolicy(ReplayPastSteps))
+	defer crl.Close()
+	stepTokens := make(chan string, 1)
+	send := startHistorySession(crl, func(s *Session) {
+		stepTokens <- s.StepToken()
+	})
+
+	first := <-stepTokens
+	send(first)
+	second := <-stepTokens
+	send(second)
+	<-stepTokens
+
+	// The response to the first step's request is replayed
+	w := send(first)
+	if w.Code != http.StatusCreated || w.Body.String() != "step 1" || w.Header().Get(StepHeader) != second {
+		t.Fatalf("Expected the first step's response to be replayed got %d %s\n", w.Code, w.Body.String())
+	}
+	if len(w.Result().Cookies()) != 1 {
+		t.Fatalf("Expected only the current session cookie got %v\n", w.Result().Cookies())
+	}
+
+	// The session didn't see the replayed request
+	if w := send(""); w.Body.String() != "step 3" {
+		t.Fatalf("Expected the session to continue got %s\n", w.Body.String())
+	}
+}
+
+func TestRejectPastSteps_RejectsPastAndUnknownSteps(t *testing.T) {
+	crl := newTestController(WithPastStepPolicy(RejectPastSteps))
+	defer crl.Close()
+	stepTokens := make(chan string, 1)
+	send := startHistorySession(crl, func(s *Session) {
+		stepTokens <- s.StepToken()
+	})
+
+	first := <-stepTokens
+	send(first)
+	<-stepTokens
+
+	for _, token := range []string{first, "7.forged", "forged"} {
+		if w := send(token); w.Code != http.StatusConflict {
+			t.Fatalf("Expected %d for %s got %d\n", http.StatusConflict, token, w.Code)
+		}
+	}
+}
+
+func TestRewindPastSteps_RewindsToCheckpoint(t *testing.T) {
+	crl := newTestController(WithPastStepPolicy(RewindPastSteps))
+	defer crl.Close()
+	stepTokens := make(chan string, 1)
+	rewinds := make(chan int, 1)
+	send := startHistorySession(crl, func(s *Session) {
+		if checkpoint, ok := s.Rewound(); ok {
+			rewinds <- checkpoint
+		}
+		if s.Step() == 1 {
+			s.Checkpoint()
+		}
+		stepTokens <- s.StepToken()
+	})
+
+	<-stepTokens
+	send("")
+	checkpoint := <-stepTokens
+	send("")
+	past := <-stepTokens
+	send("")
+	<-stepTokens
+
+	if w := send(past); w.Body.String() != "step 2" {
+		t.Fatalf("Expected the session to resume after the checkpoint got %s\n", w.Body.String())
+	}
+	if rewound := <-rewinds; rewound != 1 {
+		t.Fatalf("Expected to rewind to step 1 got %d\n", rewound)
+	}
+	<-stepTokens
+
+	// The steps after the checkpoint were discarded
+	if w := send(past); w.Code != http.StatusConflict {
+		t.Fatalf("Expected a discarded step to be out of sequence got %d\n", w.Code)
+	}
+	if w := send(checkpoint); w.Body.String() != "step 2" {
+		t.Fatalf("Expected the session to rewind to the checkpoint got %s\n", w.Body.String())
+	}
+	<-rewinds
+}
+
+func TestMaxHistory_ForgetsOldestSteps(t *testing.T) {
+	crl := newTestController(WithPastStepPolicy(ReplayPastSteps), WithMaxHistory(2))
+	defer crl.Close()
+	sessions := make(chan *Session, 1)
+	stepTokens := make(chan string, 1)
+	send := startHistorySession(crl, func(s *Session) {
+		sessions <- s
+		stepTokens <- s.StepToken()
+	})
+
+	session := <-sessions
+	first := <-stepTokens
+	for i := 0; i < 3; i++ {
+		send("")
+		<-sessions
+		<-stepTokens
+	}
+
+	session.historyMutex.Lock()
+	steps, firstStep := len(session.history), session.firstStep
+	session.historyMutex.Unlock()
+	if steps != 2 || firstStep != 2 {
+		t.Fatalf("Expected steps 2 and 3 to be kept got %d steps from %d\n", steps, firstStep)
+	}
+
+	// The first step's response was forgotten
+	if w := send(first); w.Code != http.StatusConflict {
+		t.Fatalf("Expected a forgotten step to be out of sequence got %d\n", w.Code)
+	}
+}
+
+func TestRewindPastSteps_ResolvesQueuedRequestsOnceAdmitted(t *testing.T) {
+	crl := newTestController(WithPastStepPolicy(RewindPastSteps), WithMaxHistory(3))
+	defer crl.Close()
+	stepTokens := make(chan string, 10)
+	gate := make(chan struct{}, 10)
+	gate <- struct{}{}
+	send := startHistorySession(crl, func(s *Session) {
+		if s.Step() == 1 {
+			s.Checkpoint()
+		}
+		stepTokens <- s.StepToken()
+		<-gate
+	})
+	<-stepTokens
+	gate <- struct{}{}
+	send("")
+	checkpoint := <-stepTokens
+	gate <- struct{}{}
+	send("")
+	<-stepTokens
+
+	// The session holds step 3 while two requests and then one from the
+	// checkpoint's page queue behind it. The two requests push the
+	// checkpoint out of the history.
+	responses := make(chan *httptest.ResponseRecorder, 4)
+	for _, stepToken := range []string{"", "", "", checkpoint} {
+		go func(stepToken string) {
+			responses <- send(stepToken)
+		}(stepToken)
+		time.Sleep(10 * time.Millisecond)
+	}
+	for i := 0; i < 4; i++ {
+		gate <- struct{}{}
+	}
+	for i := 0; i < 4; i++ {
+		if w := <-responses; w.Code != http.StatusCreated && w.Code != http.StatusConflict {
+			t.Fatalf("Expected the step or out of sequence got %d %s\n", w.Code, w.Body.String())
+		}
+	}
+
+	// The session is still running
+	gate <- struct{}{}
+	if w := send(""); w.Code != http.StatusCreated {
+		t.Fatalf("Expected the session to carry on got %d %s\n", w.Code, w.Body.String())
+	}
+}
+
+func TestAddStep_RejectsRewindOutsideHistory(t *testing.T) {
+	session := &Session{keepHistory: true, maxHistory: 2}
+	for i := 0; i < 4; i++ {
+		session.addStep(&httpRequest{})
+	}
+
+	if session.addStep(&httpRequest{rewind: true, rewindTo: 1}) {
+		t.Fatalf("Expected a rewind to a forgotten step to be rejected\n")
+	}
+	if session.Step() != 3 {
+		t.Fatalf("Expected the history to be unchanged got step %d\n", session.Step())
+	}
+}
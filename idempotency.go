@@ -0,0 +1,40 @@
+package statesman
+
+import "net/http"
+
+// IdempotencyKeyHeader is the request header that identifies retries of a
+// request when idempotent replay is enabled
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// A request handled by a session and the response it got
+type handledRequest struct {
+	method string
+	path   string
+	// The step token and idempotency key the request carried
+	stepToken      string
+	idempotencyKey string
+	// The session token issued in the response, which replaces the one the
+	// request carried if the key was rotated
+	token    string
+	response *cachedResponse
+}
+
+// Return the last request the session handled if r is a duplicate of it,
+// otherwise nil. A duplicate has the same method and path, so a key that's
+// reused for another step isn't answered with this step's response.
+func (session *Session) duplicateOf(r *http.Request) *handledRequest {
+	session.historyMutex.Lock()
+	last := session.last
+	session.historyMutex.Unlock()
+	if last == nil || r.Method != last.method || r.URL.Path != last.path {
+		return nil
+	}
+
+	if key := r.Header.Get(IdempotencyKeyHeader); key != "" && key == last.idempotencyKey {
+		return last
+	}
+	if token := requestStepToken(r); token != "" && token == last.stepToken {
+		return last
+	}
+	return nil
+}
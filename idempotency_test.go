@@ -0,0 +1,183 @@
+package statesman
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Start a session that responds with its steps and return a function that
+// sends a request with an idempotency key to it
+func startIdempotentSession(crl *Controller) func(key string) *httptest.ResponseRecorder {
+	cookies := startTestSession(crl, respondWithSteps(func(s *Session) {}))
+	return func(key string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/", nil)
+		if key != "" {
+			r.Header.Set(IdempotencyKeyHeader, key)
+		}
+		return sendTestRequest(crl, r, cookies)
+	}
+}
+
+func TestIdempotentReplay_ReplaysResponseToSameKey(t *testing.T) {
+	crl := newTestController(WithIdempotentReplay())
+	defer crl.Close()
+	send := startIdempotentSession(crl)
+
+	if w := send("a"); w.Body.String() != "step 1" {
+		t.Fatalf("Expected the first step got %s\n", w.Body.String())
+	}
+
+	// The retry gets the same response without advancing the session
+	w := send("a")
+	if w.Code != http.StatusCreated || w.Body.String() != "step 1" {
+		t.Fatalf("Expected the response to be replayed got %d %s\n", w.Code, w.Body.String())
+	}
+	if len(w.Result().Cookies()) != 1 {
+		t.Fatalf("Expected the session cookie to be issued got %v\n", w.Result().Cookies())
+	}
+
+	if w := send("b"); w.Body.String() != "step 2" {
+		t.Fatalf("Expected a new key to advance the session got %s\n", w.Body.String())
+	}
+}
+
+func TestIdempotentReplay_ReplaysResponseToSameStepToken(t *testing.T) {
+	crl := newTestController(WithIdempotentReplay())
+	defer crl.Close()
+	stepTokens := make(chan string, 1)
+	send := startHistorySession(crl, func(s *Session) {
+		stepTokens <- s.StepToken()
+	})
+
+	first := <-stepTokens
+	send(first)
+	second := <-stepTokens
+
+	w := send(first)
+	if w.Code != http.StatusCreated || w.Body.String() != "step 1" || w.Header().Get(StepHeader) != second {
+		t.Fatalf("Expected the response to be replayed got %d %s\n", w.Code, w.Body.String())
+	}
+
+	send(second)
+	if token := <-stepTokens; token == second {
+		t.Fatalf("Expected the session to advance\n")
+	}
+}
+
+func TestIdempotentReplay_TakesPrecedenceOverRejectPastSteps(t *testing.T) {
+	crl := newTestController(WithIdempotentReplay(), WithPastStepPolicy(RejectPastSteps))
+	defer crl.Close()
+	stepTokens := make(chan string, 1)
+	send := startHistorySession(crl, func(s *Session) {
+		stepTokens <- s.StepToken()
+	})
+
+	first := <-stepTokens
+	send(first)
+	<-stepTokens
+
+	if w := send(first); w.Code != http.StatusCreated || w.Body.String() != "step 1" {
+		t.Fatalf("Expected the response to be replayed got %d %s\n", w.Code, w.Body.String())
+	}
+}
+
+func TestIdempotentReplay_OnlyReplaysSameMethodAndPath(t *testing.T) {
+	crl := newTestController(WithIdempotentReplay())
+	defer crl.Close()
+	cookies := startTestSession(crl, respondWithSteps(func(s *Session) {}))
+	send := func(method string, path string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, nil)
+		r.Header.Set(IdempotencyKeyHeader, "a")
+		return sendTestRequest(crl, r, cookies)
+	}
+
+	send(http.MethodPost, "/confirm")
+	if w := send(http.MethodPost, "/pay"); w.Body.String() != "step 2" {
+		t.Fatalf("Expected a reused key for another path to reach the session got %s\n", w.Body.String())
+	}
+	if w := send(http.MethodPut, "/pay"); w.Body.String() != "step 3" {
+		t.Fatalf("Expected a reused key for another method to reach the session got %s\n", w.Body.String())
+	}
+	if w := send(http.MethodPut, "/pay"); w.Body.String() != "step 3" {
+		t.Fatalf("Expected the retry to be replayed got %s\n", w.Body.String())
+	}
+}
+
+func TestIdempotentReplay_IgnoresOutOfSequenceResponses(t *testing.T) {
+	crl := newTestController(WithIdempotentReplay())
+	defer crl.Close()
+	cookies := startTestSession(crl, func(s *Session) {
+		s.First()
+		for {
+			w, _ := s.NextPath("/step")
+			if w == nil {
+				return
+			}
+			w.WriteHeader(http.StatusCreated)
+			fmt.Fprintf(w, "step %d", s.Step())
+		}
+	})
+	send := func(path string, key string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, path, nil)
+		r.Header.Set(IdempotencyKeyHeader, key)
+		return sendTestRequest(crl, r, cookies)
+	}
+
+	send("/step", "a")
+	if w := send("/other", "b"); w.Code != http.StatusConflict {
+		t.Fatalf("Expected %d got %d\n", http.StatusConflict, w.Code)
+	}
+	if w := send("/step", "a"); w.Code != http.StatusCreated || w.Body.String() != "step 1" {
+		t.Fatalf("Expected the step's response to be replayed got %d %s\n", w.Code, w.Body.String())
+	}
+	if w := send("/step", "c"); w.Body.String() != "step 2" {
+		t.Fatalf("Expected the session to advance once got %s\n", w.Body.String())
+	}
+}
+
+func TestIdempotentReplay_ReissuesRotatedKey(t *testing.T) {
+	crl := newTestController(WithIdempotentReplay(), WithKeyRotation(time.Minute))
+	defer crl.Close()
+	cookies := startTestSession(crl, respondWithSteps(func(s *Session) {}))
+	send := func(key string, cookies []*http.Cookie) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/", nil)
+		r.Header.Set(IdempotencyKeyHeader, key)
+		return sendTestRequest(crl, r, cookies)
+	}
+
+	rotated := send("a", cookies).Result().Cookies()
+
+	// The retry carries the retired key but gets the rotated one
+	w := send("a", cookies)
+	if w.Code != http.StatusCreated || w.Body.String() != "step 1" {
+		t.Fatalf("Expected the response to be replayed got %d %s\n", w.Code, w.Body.String())
+	}
+	replayed := w.Result().Cookies()
+	if len(replayed) != 1 || replayed[0].Value != rotated[0].Value {
+		t.Fatalf("Expected the rotated key to be reissued got %v\n", replayed)
+	}
+
+	if w := send("b", replayed); w.Body.String() != "step 2" {
+		t.Fatalf("Expected the reissued key to advance the session got %d %s\n", w.Code, w.Body.String())
+	}
+}
+
+func TestIdempotentReplay_RequiresRotationGrace(t *testing.T) {
+	if _, err := NewController(WithIdempotentReplay(), WithKeyRotation(0)); err == nil {
+		t.Fatalf("NewController should have returned an err\n")
+	}
+}
+
+func TestIdempotentReplay_DisabledPassesRetriesToSession(t *testing.T) {
+	crl := newTestController()
+	defer crl.Close()
+	send := startIdempotentSession(crl)
+
+	send("a")
+	if w := send("a"); w.Body.String() != "step 2" {
+		t.Fatalf("Expected the retry to reach the session got %s\n", w.Body.String())
+	}
+}
@@ -0,0 +1,51 @@
+package statesman
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+)
+
+// ErrTooManySessions is the session limit reason for a new session that would
+// exceed the Controller's maximum number of active sessions.
+var ErrTooManySessions = errors.New("Too many sessions.")
+
+// ErrTooManyClientSessions is the session limit reason for a new session that
+// would exceed the maximum number of active sessions of its client.
+var ErrTooManyClientSessions = errors.New("Too many sessions for client.")
+
+// The context key of the reason a new session was refused
+type sessionLimitReasonKey struct{}
+
+// SessionLimitReason returns why a request passed to the session limit
+// handler was refused, ErrTooManySessions or ErrTooManyClientSessions. It
+// returns nil for other requests.
+func SessionLimitReason(r *http.Request) error {
+	reason, _ := r.Context().Value(sessionLimitReasonKey{}).(error)
+	return reason
+}
+
+// RemoteHost returns the IP address of the request's client without the port.
+// It's the default client key for per-client session limits.
+func RemoteHost(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// Identify the client of a request for per-client session limits
+func (clr *Controller) clientKey(r *http.Request) string {
+	if clr.options.ClientKey != nil {
+		return clr.options.ClientKey(r)
+	}
+	return RemoteHost(r)
+}
+
+// Respond to a request for a new session that was refused for the given
+// reason
+func (clr *Controller) sessionLimited(w http.ResponseWriter, r *http.Request, reason error) {
+	ctx := context.WithValue(r.Context(), sessionLimitReasonKey{}, reason)
+	clr.options.SessionLimitHandler(w, r.WithContext(ctx))
+}
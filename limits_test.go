@@ -0,0 +1,96 @@
+package statesman
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestRemoteHost_RemovesPort(t *testing.T) {
+	addrs := map[string]string{
+		"192.0.2.1:1234":   "192.0.2.1",
+		"[2001:db8::1]:80": "2001:db8::1",
+		"192.0.2.1":        "192.0.2.1",
+	}
+	for addr, expected := range addrs {
+		if host := RemoteHost(&http.Request{RemoteAddr: addr}); host != expected {
+			t.Fatalf("Expected %s got %s\n", expected, host)
+		}
+	}
+}
+
+func TestRegister_LimitsActiveSessions(t *testing.T) {
+	crl := newTestController(WithMaxSessions(1))
+	defer crl.Close()
+
+	if err := crl.register("first", &Session{}); err != nil {
+		t.Fatalf("Unexpected error %v\n", err)
+	}
+	if err := crl.register("second", &Session{}); err != ErrTooManySessions {
+		t.Fatalf("Expected %v got %v\n", ErrTooManySessions, err)
+	}
+	crl.unregister("first")
+	if err := crl.register("second", &Session{}); err != nil {
+		t.Fatalf("Unexpected error %v\n", err)
+	}
+}
+
+func TestRegister_LimitsActiveSessionsPerClient(t *testing.T) {
+	crl := newTestController(WithMaxSessionsPerClient(1, nil))
+	defer crl.Close()
+
+	if err := crl.register("first", &Session{client: "a"}); err != nil {
+		t.Fatalf("Unexpected error %v\n", err)
+	}
+	if err := crl.register("second", &Session{client: "a"}); err != ErrTooManyClientSessions {
+		t.Fatalf("Expected %v got %v\n", ErrTooManyClientSessions, err)
+	}
+	if err := crl.register("third", &Session{client: "b"}); err != nil {
+		t.Fatalf("Another client's session should be registered got %v\n", err)
+	}
+	crl.unregister("first")
+	if err := crl.register("second", &Session{client: "a"}); err != nil {
+		t.Fatalf("Unexpected error %v\n", err)
+	}
+}
+
+func TestSessionStart_RefusesSessionsOverLimit(t *testing.T) {
+	limits := []struct {
+		option   Option
+		expected int
+	}{
+		{WithMaxSessions(1), http.StatusServiceUnavailable},
+		{WithMaxSessionsPerClient(1, nil), http.StatusTooManyRequests},
+		{WithMaxSessionsPerClient(1, func(r *http.Request) string {
+			return r.Header.Get("X-Client")
+		}), http.StatusTooManyRequests},
+	}
+	for _, limit := range limits {
+		crl := newTestController(limit.option)
+		firstHandler := crl.SessionStart(func(s *Session) {
+			s.First()
+			s.Next()
+		})
+
+		tc := newTestClient()
+		tc.r.RemoteAddr = "192.0.2.1:1234"
+		tc.r.Header.Set("X-Client", "client")
+		firstHandler(tc.w, tc.r)
+
+		tc = newTestClient()
+		tc.r.RemoteAddr = "192.0.2.1:5678"
+		tc.r.Header.Set("X-Client", "client")
+		firstHandler(tc.w, tc.r)
+		if tc.w.status != limit.expected {
+			t.Fatalf("Expected %d got %d\n", limit.expected, tc.w.status)
+		}
+
+		tc = newTestClient()
+		tc.r.RemoteAddr = "192.0.2.2:1234"
+		tc.r.Header.Set("X-Client", "another client")
+		firstHandler(tc.w, tc.r)
+		if limit.expected == http.StatusTooManyRequests && tc.w.status != 0 {
+			t.Fatalf("Another client's session should have started got %d\n", tc.w.status)
+		}
+		crl.Close()
+	}
+}
@@ -0,0 +1,154 @@
+package statesman
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// DefaultStartPath is the path, relative to the workflow's prefix, of the
+// request that starts a session of a workflow used as an http.Handler.
+const DefaultStartPath = "/"
+
+// The context key of the mount prefix removed from a request's path
+type mountPrefixKey struct{}
+
+// MountPrefix returns the prefix that was removed from the path of a request
+// routed by a Workflow used as an http.Handler, without its trailing slash, as
+// in "/checkout". Joining it onto a path the session sees, such as one from
+// ExpectedPaths, gives the path the client must request. It's empty for other
+// requests.
+func MountPrefix(r *http.Request) string {
+	prefix, _ := r.Context().Value(mountPrefixKey{}).(string)
+	return prefix
+}
+
+// WorkflowOption configures how a Workflow routes requests when it's used as
+// an http.Handler.
+type WorkflowOption func(*Workflow) error
+
+// WithMountPrefix sets the path the workflow is mounted at, such as
+// "/checkout/". It defaults to "/".
+func WithMountPrefix(prefix string) WorkflowOption {
+	return func(wf *Workflow) error {
+		if !strings.HasPrefix(prefix, "/") {
+			return fmt.Errorf("Invalid mount prefix \"%s\".", prefix)
+		}
+		if !strings.HasSuffix(prefix, "/") {
+			prefix += "/"
+		}
+		wf.prefix = prefix
+		return nil
+	}
+}
+
+// WithStartPath sets the path, relative to the mount prefix, of the request
+// that starts a session. It defaults to DefaultStartPath.
+func WithStartPath(path string) WorkflowOption {
+	return func(wf *Workflow) error {
+		if !strings.HasPrefix(path, "/") {
+			return fmt.Errorf("Invalid start path \"%s\".", path)
+		}
+		wf.startPath = path
+		return nil
+	}
+}
+
+// WithSteps sets the paths, relative to the mount prefix, of the workflow's
+// steps. Requests for other paths get a 404 Not Found instead of being routed
+// to a session. Without it every path under the prefix is routed to the
+// workflow's sessions.
+func WithSteps(paths ...string) WorkflowOption {
+	return func(wf *Workflow) error {
+		for _, path := range paths {
+			if !strings.HasPrefix(path, "/") {
+				return fmt.Errorf("Invalid step path \"%s\".", path)
+			}
+		}
+		wf.steps = paths
+		return nil
+	}
+}
+
+// WithPastSteps sets what happens to requests from the pages of past steps of
+// the workflow's sessions. It defaults to the Controller's PastSteps option.
+func WithPastSteps(policy PastStepPolicy) WorkflowOption {
+	return func(wf *Workflow) error {
+		if policy < ContinuePastSteps || policy > RejectPastSteps {
+			return fmt.Errorf("Invalid past step policy %d.", policy)
+		}
+		wf.pastSteps = policy
+		return nil
+	}
+}
+
+// Join a path relative to the prefix onto it
+func (wf *Workflow) fullPath(path string) string {
+	return strings.TrimSuffix(wf.prefix, "/") + path
+}
+
+// StartPath returns the path of the request that starts a session of the
+// workflow when it's used as an http.Handler.
+func (wf *Workflow) StartPath() string {
+	return wf.fullPath(wf.startPath)
+}
+
+// Steps returns the paths of the workflow's known steps, nil if every path
+// under the mount prefix is routed to its sessions.
+func (wf *Workflow) Steps() []string {
+	if wf.steps == nil {
+		return nil
+	}
+	paths := make([]string, len(wf.steps))
+	for i, path := range wf.steps {
+		paths[i] = wf.fullPath(path)
+	}
+	return paths
+}
+
+// Whether the path, relative to the prefix, is one of the known steps
+func (wf *Workflow) isStep(path string) bool {
+	if wf.steps == nil {
+		return true
+	}
+	for _, step := range wf.steps {
+		if path == step {
+			return true
+		}
+	}
+	return false
+}
+
+// ServeHTTP routes requests for the start path to SessionStart and requests
+// for the workflow's steps to SessionHandler. The mount prefix is removed from
+// the path of the requests passed to the workflow's sessions, so "/checkout/"
+// and "/checkout/confirm" are seen as "/" and "/confirm".
+func (wf *Workflow) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.URL.Path, wf.prefix) && r.URL.Path != strings.TrimSuffix(wf.prefix, "/") {
+		http.NotFound(w, r)
+		return
+	}
+
+	stripped := new(http.Request)
+	*stripped = *r
+	stripped.URL = new(url.URL)
+	*stripped.URL = *r.URL
+	stripped.URL.Path = "/" + strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, strings.TrimSuffix(wf.prefix, "/")), "/")
+	stripped.URL.RawPath = ""
+	if prefix := strings.TrimSuffix(wf.prefix, "/"); prefix != "" {
+		stripped = stripped.WithContext(context.WithValue(r.Context(), mountPrefixKey{}, prefix))
+	}
+
+	if stripped.URL.Path == wf.startPath {
+		wf.SessionStart()(w, stripped)
+		return
+	}
+	// The session token may be part of the path
+	if !wf.isStep(rewriteRequest(wf.transport(), stripped).URL.Path) {
+		http.NotFound(w, r)
+		return
+	}
+	wf.SessionHandler()(w, stripped)
+}
@@ -0,0 +1,146 @@
+package statesman
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNewWorkflow_RejectsInvalidWorkflowOptions(t *testing.T) {
+	crl := newTestController()
+	defer crl.Close()
+
+	opts := []WorkflowOption{
+		WithMountPrefix("checkout/"),
+		WithStartPath("start"),
+		WithSteps("/confirm", "cancel"),
+		WithPastSteps(RejectPastSteps + 1),
+	}
+	for _, opt := range opts {
+		if _, err := crl.NewWorkflow("checkout", func(*Session) {}, opt); err == nil {
+			t.Fatalf("NewWorkflow should have returned an err\n")
+		}
+	}
+}
+
+func TestWorkflow_ListsStartPathAndSteps(t *testing.T) {
+	crl := newTestController()
+	defer crl.Close()
+
+	wf, _ := crl.NewWorkflow("checkout", func(*Session) {})
+	if wf.StartPath() != "/" || wf.Steps() != nil {
+		t.Fatalf("Expected the default routes got %s %v\n", wf.StartPath(), wf.Steps())
+	}
+
+	wf, _ = crl.NewWorkflow("mounted", func(*Session) {},
+		WithMountPrefix("/checkout"),
+		WithStartPath("/start"),
+		WithSteps("/confirm", "/cancel"),
+	)
+	if wf.StartPath() != "/checkout/start" {
+		t.Fatalf("Expected the start path under the prefix got %s\n", wf.StartPath())
+	}
+	if steps := wf.Steps(); len(steps) != 2 || steps[0] != "/checkout/confirm" || steps[1] != "/checkout/cancel" {
+		t.Fatalf("Expected the steps under the prefix got %v\n", steps)
+	}
+}
+
+func TestWorkflow_ServeHTTPRoutesRequestsUnderPrefix(t *testing.T) {
+	crl := newTestController(WithCookieSettings(CookieSettings{Name: DefaultCookieName, Path: "/"}))
+	defer crl.Close()
+	paths := make(chan string, 1)
+	wf, _ := crl.NewWorkflow("checkout", func(s *Session) {
+		_, r := s.First()
+		paths <- r.URL.Path
+		for {
+			w, r := s.Next()
+			if w == nil {
+				return
+			}
+			paths <- r.URL.Path
+		}
+	}, WithMountPrefix("/checkout/"), WithSteps("/confirm"))
+	mux := http.NewServeMux()
+	mux.Handle("/checkout/", wf)
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/checkout/", nil))
+	if path := <-paths; path != "/" {
+		t.Fatalf("Expected the session to start with / got %s\n", path)
+	}
+	cookies := w.Result().Cookies()
+
+	requests := map[string]int{
+		"/checkout/confirm": http.StatusOK,
+		"/checkout/unknown": http.StatusNotFound,
+	}
+	for path, status := range requests {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		for _, cookie := range cookies {
+			r.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		if w.Code != status {
+			t.Fatalf("Expected %d for %s got %d\n", status, path, w.Code)
+		}
+	}
+	if path := <-paths; path != "/confirm" {
+		t.Fatalf("Expected the prefix to be removed got %s\n", path)
+	}
+
+	w = httptest.NewRecorder()
+	wf.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/other", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("Expected paths outside the prefix not to be found got %d\n", w.Code)
+	}
+}
+
+func TestWorkflow_ServeHTTPRoutesPathTokens(t *testing.T) {
+	crl := newTestController(WithPathTransport())
+	defer crl.Close()
+	tokens := make(chan string, 1)
+	paths := make(chan string, 1)
+	wf, _ := crl.NewWorkflow("checkout", func(s *Session) {
+		s.First()
+		tokens <- s.Token()
+		_, r := s.Next()
+		paths <- r.URL.Path
+	}, WithMountPrefix("/checkout/"), WithStartPath("/start"), WithSteps("/confirm"))
+
+	wf.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/checkout/start", nil))
+	w := httptest.NewRecorder()
+	wf.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/checkout/confirm/"+<-tokens, nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected the step to be routed got %d\n", w.Code)
+	}
+	if path := <-paths; path != "/confirm" {
+		t.Fatalf("Expected the step's path got %s\n", path)
+	}
+}
+
+func TestWorkflow_ServeHTTPRedirectsOutOfSequenceUnderPrefix(t *testing.T) {
+	crl := newTestController(
+		WithCookieSettings(CookieSettings{Name: DefaultCookieName, Path: "/"}),
+		WithOutOfSequenceHandler(OutOfSequenceRedirect(http.StatusSeeOther)),
+	)
+	defer crl.Close()
+	wf, _ := crl.NewWorkflow("checkout", func(s *Session) {
+		s.First()
+		s.NextPath("/confirm")
+	}, WithMountPrefix("/checkout/"))
+
+	w := httptest.NewRecorder()
+	wf.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/checkout/", nil))
+	r := httptest.NewRequest(http.MethodGet, "/checkout/other", nil)
+	for _, cookie := range w.Result().Cookies() {
+		r.AddCookie(cookie)
+	}
+	w = httptest.NewRecorder()
+	wf.ServeHTTP(w, r)
+
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/checkout/confirm" {
+		t.Fatalf("Expected a redirect to /checkout/confirm got %d %s\n", w.Code, w.Header().Get("Location"))
+	}
+}
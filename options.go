@@ -0,0 +1,644 @@
+package statesman
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// DefaultTimeout is the default session timeout used by DefaultOptions
+var DefaultTimeout time.Duration
+
+// DefaultInvalidSessionHandler is the default function called when a session
+// handler endpoint is called without a valid session.
+var DefaultInvalidSessionHandler func(http.ResponseWriter, *http.Request)
+
+// DefaultUnavailableHandler is the default function called when a session
+// start endpoint is called while the Controller is shutting down, or any
+// endpoint is called after the Controller has been closed.
+var DefaultUnavailableHandler func(http.ResponseWriter, *http.Request)
+
+// DefaultErrorHandler is the default function called to respond to the
+// pending request of a session whose function panicked.
+var DefaultErrorHandler func(http.ResponseWriter, *http.Request)
+
+// DefaultPanicHandler is the default function called with the value and stack
+// trace of a panic recovered from a session function.
+var DefaultPanicHandler func(value interface{}, stack []byte)
+
+// DefaultCSRFFailureHandler is the default function called when an unsafe
+// request of a session doesn't carry the step's CSRF token.
+var DefaultCSRFFailureHandler func(http.ResponseWriter, *http.Request)
+
+// DefaultSessionLimitHandler is the default function called when a new
+// session is refused because of a session limit. It responds with 429 Too
+// Many Requests when the client has too many sessions, otherwise with 503
+// Service Unavailable.
+var DefaultSessionLimitHandler func(http.ResponseWriter, *http.Request)
+
+// DefaultRateLimitHandler is the default function called when a request is
+// rejected by a rate limit. The Retry-After header has already been set.
+var DefaultRateLimitHandler func(http.ResponseWriter, *http.Request)
+
+// DefaultConflictHandler is the default function called when a request is
+// rejected or superseded because its session is handling another request.
+var DefaultConflictHandler func(http.ResponseWriter, *http.Request)
+
+// DefaultOutOfSequenceHandler is the default function called with a request
+// that a session waiting in NextMatching or NextPath didn't expect.
+var DefaultOutOfSequenceHandler func(http.ResponseWriter, *http.Request)
+
+// The smallest signing key accepted by WithSigningKeys
+const minSigningKeySize = 32
+
+// DefaultCookieName is the name of the session cookie used by
+// DefaultCookieSettings
+const DefaultCookieName = "Statesman"
+
+// DefaultCookieSettings are the session cookie settings used by DefaultOptions
+var DefaultCookieSettings CookieSettings
+
+// The DefaultOptions that NewController starts from before applying its
+// Option arguments. NewController never modifies DefaultOptions.
+var DefaultOptions Options
+
+func init() {
+	DefaultTimeout = time.Minute * 10
+	DefaultInvalidSessionHandler = func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(fmt.Sprintf("Invalid Session. (%s).", r.URL.Path)))
+	}
+	DefaultUnavailableHandler = func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(fmt.Sprintf("Service Unavailable. (%s).", r.URL.Path)))
+	}
+	DefaultErrorHandler = func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(fmt.Sprintf("Internal Server Error. (%s).", r.URL.Path)))
+	}
+	DefaultCSRFFailureHandler = func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(fmt.Sprintf("Invalid CSRF Token. (%s).", r.URL.Path)))
+	}
+	DefaultSessionLimitHandler = func(w http.ResponseWriter, r *http.Request) {
+		if SessionLimitReason(r) == ErrTooManyClientSessions {
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(fmt.Sprintf("Too Many Sessions. (%s).", r.URL.Path)))
+			return
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(fmt.Sprintf("Service Unavailable. (%s).", r.URL.Path)))
+	}
+	DefaultRateLimitHandler = func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte(fmt.Sprintf("Too Many Requests. (%s).", r.URL.Path)))
+	}
+	DefaultConflictHandler = func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte(fmt.Sprintf("Conflict. (%s).", r.URL.Path)))
+	}
+	DefaultOutOfSequenceHandler = func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte(fmt.Sprintf("Out Of Sequence. (%s).", r.URL.Path)))
+	}
+	DefaultPanicHandler = func(value interface{}, stack []byte) {
+		log.Printf("statesman: panic in session: %v\n%s", value, stack)
+	}
+	DefaultCookieSettings = CookieSettings{
+		Name:     DefaultCookieName,
+		Secure:   false,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	DefaultOptions = Options{
+		SessionTimeout:        DefaultTimeout,
+		InvalidSessionHandler: DefaultInvalidSessionHandler,
+		UnavailableHandler:    DefaultUnavailableHandler,
+		ErrorHandler:          DefaultErrorHandler,
+		PanicHandler:          DefaultPanicHandler,
+		CSRFFailureHandler:    DefaultCSRFFailureHandler,
+		SessionLimitHandler:   DefaultSessionLimitHandler,
+		RateLimitHandler:      DefaultRateLimitHandler,
+		ConflictHandler:       DefaultConflictHandler,
+		OutOfSequenceHandler:  DefaultOutOfSequenceHandler,
+		MaxHistory:            DefaultMaxHistory,
+		Cookie:                DefaultCookieSettings,
+		AcceptLegacyCookies:   true,
+	}
+}
+
+// Options configures the Controller
+type Options struct {
+	// Sessions that don't receive a request within the timeout are expired
+	SessionTimeout time.Duration
+	// Called when a session handler endpoint is called without a valid
+	// session
+	InvalidSessionHandler func(http.ResponseWriter, *http.Request)
+	// Called when a session can't be started because the controller is
+	// shutting down, or a request arrives after it has been closed
+	UnavailableHandler func(http.ResponseWriter, *http.Request)
+	// Called to respond to the pending request of a session that panicked
+	ErrorHandler func(http.ResponseWriter, *http.Request)
+	// Called with the value and stack trace of a session that panicked
+	PanicHandler func(value interface{}, stack []byte)
+	// Attributes of the session cookie
+	Cookie CookieSettings
+	// Also accept session keys from cookies in the legacy "Statesman-<key>"
+	// format. Legacy cookies are replaced with the current format. They're
+	// never accepted when signing or encryption keys are set.
+	AcceptLegacyCookies bool
+	// HMAC-SHA256 keys for signing session tokens. The first key signs new
+	// tokens and all of them are accepted so keys can be rotated. Tampered or
+	// expired tokens are rejected before the session is looked up.
+	SigningKeys [][]byte
+	// AES keys (16, 24 or 32 bytes) for encrypting session tokens with
+	// AES-GCM. The first key encrypts new tokens and all of them are accepted
+	// so keys can be rotated.
+	EncryptionKeys [][]byte
+	// How session tokens are carried between the client and the Controller.
+	// When nil a CookieTransport is created from the Cookie settings.
+	Transport SessionTransport
+	// Issue a new session key with every request handled by SessionHandler,
+	// retiring the previous one. Requests with a retired key are passed to
+	// the invalid session handler with ErrSessionKeyRetired.
+	RotateKeys bool
+	// How long a retired key is still accepted after rotation, so that
+	// duplicate requests already in flight aren't rejected
+	RotationGrace time.Duration
+	// The attributes of the client that started a session which the rest of
+	// its requests must match. Requests that don't match are passed to the
+	// invalid session handler with ErrSessionBindingMismatch.
+	Binding Binding
+	// Require the CSRF token of the session's current step with requests
+	// whose method isn't safe. See Session.CSRFToken.
+	CSRFProtection bool
+	// Called when a request fails CSRF verification
+	CSRFFailureHandler func(http.ResponseWriter, *http.Request)
+	// The maximum number of active sessions, zero for no limit
+	MaxSessions int
+	// The maximum number of active sessions of each client, zero for no
+	// limit
+	MaxSessionsPerClient int
+	// Identifies the client of a request for MaxSessionsPerClient. When nil
+	// clients are identified by RemoteHost.
+	ClientKey func(*http.Request) string
+	// Called when a new session is refused because of a session limit, see
+	// SessionLimitReason
+	SessionLimitHandler func(http.ResponseWriter, *http.Request)
+	// Limits the rate at which new sessions are started
+	StartRateLimit RateLimit
+	// Limits the rate of requests to each session
+	StepRateLimit RateLimit
+	// Called with the Retry-After header set when a request is rejected by
+	// a rate limit
+	RateLimitHandler func(http.ResponseWriter, *http.Request)
+	// What happens to a request that arrives while its session is handling
+	// another
+	Concurrency ConcurrencyPolicy
+	// Called when a request is rejected or superseded by the concurrency
+	// policy
+	ConflictHandler func(http.ResponseWriter, *http.Request)
+	// Called with requests that a session waiting in NextMatching or
+	// NextPath didn't expect, see OutOfSequenceRedirect
+	OutOfSequenceHandler func(http.ResponseWriter, *http.Request)
+	// What happens to requests from the pages of past steps of sessions of
+	// the Controller's default workflow, and the default for other
+	// workflows
+	PastSteps PastStepPolicy
+	// The most steps of a session's history kept for its PastStepPolicy,
+	// DefaultMaxHistory if zero. Requests for older steps are out of
+	// sequence.
+	MaxHistory int
+	// Buffer the last response of each session and replay it to duplicates
+	// of its request, which carry the same step token or Idempotency-Key
+	// header, instead of passing them to the session. With RotateKeys a
+	// retry carries the rotated key, so it needs a RotationGrace.
+	IdempotentReplay bool
+}
+
+// CookieSettings configures the attributes of the session cookie
+type CookieSettings struct {
+	// The name of the cookie, its value is the session key
+	Name string
+	// Only send the cookie over HTTPS. The cookie is always secure when the
+	// request arrived over TLS.
+	Secure bool
+	// Hide the cookie from JavaScript
+	HttpOnly bool
+	// Restrict sending the cookie with cross-site requests
+	SameSite http.SameSite
+	// The path the cookie applies to. When empty the browser uses the path
+	// of the request that set the cookie.
+	Path string
+	// The domain the cookie applies to. When empty the cookie only applies to
+	// the host that set it.
+	Domain string
+	// How long the browser keeps the cookie. Zero uses the session timeout
+	// and a negative MaxAge makes it a browser session cookie.
+	MaxAge time.Duration
+}
+
+// The cookie settings to use for a response to r
+func (settings CookieSettings) forRequest(r *http.Request) CookieSettings {
+	if r.TLS != nil {
+		settings.Secure = true
+	}
+	return settings
+}
+
+// Option modifies the Options used to construct a Controller. The resulting
+// Options are validated by NewController.
+type Option func(*Options) error
+
+func (options *Options) validate() error {
+	if options.SessionTimeout <= 0 {
+		return fmt.Errorf("Invalid session timeout %v.", options.SessionTimeout)
+	}
+	if options.InvalidSessionHandler == nil {
+		return errors.New("Missing invalid session handler.")
+	}
+	if options.UnavailableHandler == nil {
+		return errors.New("Missing unavailable handler.")
+	}
+	if options.ErrorHandler == nil {
+		return errors.New("Missing error handler.")
+	}
+	if options.PanicHandler == nil {
+		return errors.New("Missing panic handler.")
+	}
+	if options.OutOfSequenceHandler == nil {
+		return errors.New("Missing out of sequence handler.")
+	}
+	if !isValidCookieName(options.Cookie.Name) {
+		return fmt.Errorf("Invalid cookie name \"%s\".", options.Cookie.Name)
+	}
+	for _, key := range options.SigningKeys {
+		if len(key) < minSigningKeySize {
+			return fmt.Errorf("Signing keys must be at least %d bytes.", minSigningKeySize)
+		}
+	}
+	for _, key := range options.EncryptionKeys {
+		if len(key) != 16 && len(key) != 24 && len(key) != 32 {
+			return errors.New("Encryption keys must be 16, 24 or 32 bytes.")
+		}
+	}
+	if options.RotationGrace < 0 {
+		return fmt.Errorf("Invalid rotation grace %v.", options.RotationGrace)
+	}
+	if options.CSRFProtection && options.CSRFFailureHandler == nil {
+		return errors.New("Missing CSRF failure handler.")
+	}
+	if options.MaxSessions < 0 || options.MaxSessionsPerClient < 0 {
+		return errors.New("Session limits can't be negative.")
+	}
+	if (options.MaxSessions != 0 || options.MaxSessionsPerClient != 0) && options.SessionLimitHandler == nil {
+		return errors.New("Missing session limit handler.")
+	}
+	for _, limit := range []RateLimit{options.StartRateLimit, options.StepRateLimit} {
+		if limit.Rate < 0 || (limit.Rate > 0 && limit.Burst < 1) {
+			return fmt.Errorf("Invalid rate limit %+v.", limit)
+		}
+		if limit.Rate > 0 && options.RateLimitHandler == nil {
+			return errors.New("Missing rate limit handler.")
+		}
+	}
+	if options.Concurrency < QueueRequests || options.Concurrency > CancelOlderRequests {
+		return fmt.Errorf("Invalid concurrency policy %d.", options.Concurrency)
+	}
+	if options.Concurrency != QueueRequests && options.ConflictHandler == nil {
+		return errors.New("Missing conflict handler.")
+	}
+	if options.PastSteps < ContinuePastSteps || options.PastSteps > RejectPastSteps {
+		return fmt.Errorf("Invalid past step policy %d.", options.PastSteps)
+	}
+	if options.IdempotentReplay && options.RotateKeys && options.RotationGrace == 0 {
+		return errors.New("Idempotent replay needs a key rotation grace.")
+	}
+	if options.MaxHistory < 0 {
+		return fmt.Errorf("Invalid maximum history %d.", options.MaxHistory)
+	}
+	if options.Binding&^allBindings != 0 {
+		return fmt.Errorf("Invalid binding %d.", options.Binding)
+	}
+	if options.AcceptLegacyCookies && strings.HasPrefix(options.Cookie.Name, statesmanPrefix) {
+		return fmt.Errorf("Cookie name \"%s\" clashes with legacy cookies.", options.Cookie.Name)
+	}
+	return nil
+}
+
+// Cookie names must be a non-empty HTTP token
+func isValidCookieName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if c <= ' ' || c >= 0x7f || strings.ContainsRune("()<>@,;:\\\"/[]?={}", c) {
+			return false
+		}
+	}
+	return true
+}
+
+// WithOptions replaces all of the options. Options that are left unset will
+// fail validation.
+func WithOptions(o Options) Option {
+	return func(options *Options) error {
+		*options = o
+		return nil
+	}
+}
+
+// WithSessionTimeout sets how long a session may go without receiving a
+// request before it's expired.
+func WithSessionTimeout(timeout time.Duration) Option {
+	return func(options *Options) error {
+		options.SessionTimeout = timeout
+		return nil
+	}
+}
+
+// WithInvalidSessionHandler sets the function called when a session handler
+// endpoint is called without a valid session.
+func WithInvalidSessionHandler(handler func(http.ResponseWriter, *http.Request)) Option {
+	return func(options *Options) error {
+		options.InvalidSessionHandler = handler
+		return nil
+	}
+}
+
+// WithUnavailableHandler sets the function called when a session can't be
+// started because the controller is shutting down, or a request arrives
+// after it has been closed.
+func WithUnavailableHandler(handler func(http.ResponseWriter, *http.Request)) Option {
+	return func(options *Options) error {
+		options.UnavailableHandler = handler
+		return nil
+	}
+}
+
+// WithErrorHandler sets the function called to respond to the pending request
+// of a session whose function panicked.
+func WithErrorHandler(handler func(http.ResponseWriter, *http.Request)) Option {
+	return func(options *Options) error {
+		options.ErrorHandler = handler
+		return nil
+	}
+}
+
+// WithPanicHandler sets the function called with the value and stack trace of
+// a panic recovered from a session function.
+func WithPanicHandler(handler func(value interface{}, stack []byte)) Option {
+	return func(options *Options) error {
+		options.PanicHandler = handler
+		return nil
+	}
+}
+
+// WithLegacyCookies sets whether session keys are also accepted from cookies
+// in the legacy "Statesman-<key>" format.
+func WithLegacyCookies(accept bool) Option {
+	return func(options *Options) error {
+		options.AcceptLegacyCookies = accept
+		return nil
+	}
+}
+
+// WithSigningKeys sets the keys used to sign session tokens. The first key
+// signs new tokens and all of them are accepted, so a new key can be rotated
+// in by putting it first while still accepting tokens signed with the old.
+func WithSigningKeys(keys ...[]byte) Option {
+	return func(options *Options) error {
+		options.SigningKeys = keys
+		return nil
+	}
+}
+
+// WithEncryptionKeys sets the AES keys used to encrypt session tokens. As
+// with WithSigningKeys the first key is used for new tokens and all of them
+// are accepted.
+func WithEncryptionKeys(keys ...[]byte) Option {
+	return func(options *Options) error {
+		options.EncryptionKeys = keys
+		return nil
+	}
+}
+
+// WithTransport sets how session tokens are carried between the client and
+// the Controller.
+func WithTransport(transport SessionTransport) Option {
+	return func(options *Options) error {
+		if transport == nil {
+			return errors.New("Missing session transport.")
+		}
+		options.Transport = transport
+		return nil
+	}
+}
+
+// WithHeaderTransport carries session tokens in the named request header
+// instead of a cookie. The token is issued in the same response header.
+func WithHeaderTransport(header string) Option {
+	return func(options *Options) error {
+		if header == "" {
+			return errors.New("Missing session token header.")
+		}
+		options.Transport = &HeaderTransport{Header: header}
+		return nil
+	}
+}
+
+// WithBearerTransport carries session tokens in the Authorization request
+// header using the Bearer scheme instead of a cookie. The token is issued in
+// the SessionTokenHeader response header.
+func WithBearerTransport() Option {
+	return func(options *Options) error {
+		options.Transport = &HeaderTransport{"Authorization", "Bearer", SessionTokenHeader}
+		return nil
+	}
+}
+
+// WithQueryTransport carries session tokens in the named query parameter
+// instead of a cookie. See QueryTransport.
+func WithQueryTransport(param string) Option {
+	return func(options *Options) error {
+		if param == "" {
+			return errors.New("Missing session token query parameter.")
+		}
+		options.Transport = &QueryTransport{param}
+		return nil
+	}
+}
+
+// WithPathTransport carries session tokens in the last segment of the
+// request's path instead of a cookie. See PathTransport.
+func WithPathTransport() Option {
+	return func(options *Options) error {
+		options.Transport = &PathTransport{}
+		return nil
+	}
+}
+
+// WithCookieSettings sets the attributes of the session cookie.
+func WithCookieSettings(settings CookieSettings) Option {
+	return func(options *Options) error {
+		options.Cookie = settings
+		return nil
+	}
+}
+
+// WithKeyRotation issues a new session key with every step of a session and
+// retires the previous key. Retired keys are still accepted for grace after
+// they're retired.
+func WithKeyRotation(grace time.Duration) Option {
+	return func(options *Options) error {
+		if grace < 0 {
+			return fmt.Errorf("Invalid rotation grace %v.", grace)
+		}
+		options.RotateKeys = true
+		options.RotationGrace = grace
+		return nil
+	}
+}
+
+// WithBinding binds sessions to the given attributes of the client that
+// started them.
+func WithBinding(binding Binding) Option {
+	return func(options *Options) error {
+		options.Binding = binding
+		return nil
+	}
+}
+
+// WithCSRFProtection requires requests of a session with unsafe methods to
+// carry the CSRF token of the session's current step.
+func WithCSRFProtection() Option {
+	return func(options *Options) error {
+		options.CSRFProtection = true
+		return nil
+	}
+}
+
+// WithCSRFFailureHandler sets the function called when a request fails CSRF
+// verification.
+func WithCSRFFailureHandler(handler func(http.ResponseWriter, *http.Request)) Option {
+	return func(options *Options) error {
+		options.CSRFFailureHandler = handler
+		return nil
+	}
+}
+
+// WithMaxSessions limits the number of active sessions. New sessions over the
+// limit are passed to the session limit handler.
+func WithMaxSessions(max int) Option {
+	return func(options *Options) error {
+		options.MaxSessions = max
+		return nil
+	}
+}
+
+// WithMaxSessionsPerClient limits the number of active sessions of each
+// client, as identified by clientKey or RemoteHost if it's nil. New sessions
+// over the limit are passed to the session limit handler.
+func WithMaxSessionsPerClient(max int, clientKey func(*http.Request) string) Option {
+	return func(options *Options) error {
+		options.MaxSessionsPerClient = max
+		options.ClientKey = clientKey
+		return nil
+	}
+}
+
+// WithSessionLimitHandler sets the function called when a new session is
+// refused because of a session limit.
+func WithSessionLimitHandler(handler func(http.ResponseWriter, *http.Request)) Option {
+	return func(options *Options) error {
+		options.SessionLimitHandler = handler
+		return nil
+	}
+}
+
+// WithStartRateLimit limits the rate at which new sessions are started.
+func WithStartRateLimit(limit RateLimit) Option {
+	return func(options *Options) error {
+		options.StartRateLimit = limit
+		return nil
+	}
+}
+
+// WithStepRateLimit limits the rate of requests to each session.
+func WithStepRateLimit(limit RateLimit) Option {
+	return func(options *Options) error {
+		options.StepRateLimit = limit
+		return nil
+	}
+}
+
+// WithRateLimitHandler sets the function called when a request is rejected by
+// a rate limit.
+func WithRateLimitHandler(handler func(http.ResponseWriter, *http.Request)) Option {
+	return func(options *Options) error {
+		options.RateLimitHandler = handler
+		return nil
+	}
+}
+
+// WithConcurrencyPolicy sets what happens to a request that arrives while its
+// session is handling another.
+func WithConcurrencyPolicy(policy ConcurrencyPolicy) Option {
+	return func(options *Options) error {
+		options.Concurrency = policy
+		return nil
+	}
+}
+
+// WithConflictHandler sets the function called when a request is rejected or
+// superseded by the concurrency policy.
+func WithConflictHandler(handler func(http.ResponseWriter, *http.Request)) Option {
+	return func(options *Options) error {
+		options.ConflictHandler = handler
+		return nil
+	}
+}
+
+// WithOutOfSequenceHandler sets the function called with requests that a
+// session waiting in NextMatching or NextPath didn't expect.
+func WithOutOfSequenceHandler(handler func(http.ResponseWriter, *http.Request)) Option {
+	return func(options *Options) error {
+		options.OutOfSequenceHandler = handler
+		return nil
+	}
+}
+
+// WithPastStepPolicy sets what happens to requests from the pages of past
+// steps of sessions. Workflows can override it with WithPastSteps.
+func WithPastStepPolicy(policy PastStepPolicy) Option {
+	return func(options *Options) error {
+		options.PastSteps = policy
+		return nil
+	}
+}
+
+// WithMaxHistory sets how many steps of a session's history are kept for the
+// PastStepPolicy. Requests from the pages of older steps are answered by the
+// out of sequence handler.
+func WithMaxHistory(steps int) Option {
+	return func(options *Options) error {
+		if steps < 1 {
+			return fmt.Errorf("Invalid maximum history %d.", steps)
+		}
+		options.MaxHistory = steps
+		return nil
+	}
+}
+
+// WithIdempotentReplay replays the last response of a session to duplicates of
+// its request, such as retries after a network error, instead of passing them
+// to the session as a new step.
+func WithIdempotentReplay() Option {
+	return func(options *Options) error {
+		options.IdempotentReplay = true
+		return nil
+	}
+}
@@ -0,0 +1,72 @@
+package statesman
+
+import (
+	"crypto/tls"
+	"net/http"
+	"testing"
+)
+
+func TestOptions_DefaultOptionsAreValid(t *testing.T) {
+	options := DefaultOptions
+	if err := options.validate(); err != nil {
+		t.Fatalf("DefaultOptions should be valid got %v\n", err)
+	}
+}
+
+func TestOptions_RejectsInvalidOptions(t *testing.T) {
+	opts := []Option{
+		WithSessionTimeout(0),
+		WithInvalidSessionHandler(nil),
+		WithUnavailableHandler(nil),
+		WithErrorHandler(nil),
+		WithPanicHandler(nil),
+		WithOptions(Options{}),
+		WithCookieSettings(CookieSettings{Name: ""}),
+		WithCookieSettings(CookieSettings{Name: "bad name"}),
+		WithCookieSettings(CookieSettings{Name: statesmanPrefix + "name"}),
+		WithSigningKeys([]byte("short")),
+		WithEncryptionKeys([]byte("not an AES key size")),
+		WithHeaderTransport(""),
+		WithQueryTransport(""),
+		WithTransport(nil),
+		WithKeyRotation(-1),
+		WithBinding(BindClientCert << 1),
+		WithMaxSessions(-1),
+		WithMaxSessionsPerClient(-1, nil),
+		WithStartRateLimit(RateLimit{Rate: 1}),
+		WithStepRateLimit(RateLimit{Rate: -1, Burst: 1}),
+		WithConcurrencyPolicy(CancelOlderRequests + 1),
+		WithOutOfSequenceHandler(nil),
+		WithPastStepPolicy(RejectPastSteps + 1),
+		WithMaxHistory(0),
+	}
+
+	for _, opt := range opts {
+		if _, err := NewController(opt); err == nil {
+			t.Fatalf("NewController should have returned an err\n")
+		}
+	}
+}
+
+func TestWithCookieSettings_SetsCookieSettings(t *testing.T) {
+	options := DefaultOptions
+	settings := CookieSettings{Name: "name", Secure: true}
+
+	WithCookieSettings(settings)(&options)
+
+	if options.Cookie != settings {
+		t.Fatalf("WithCookieSettings didn't set the cookie settings\n")
+	}
+}
+
+func TestCookieSettings_SecureOverTLS(t *testing.T) {
+	settings := CookieSettings{}
+	r := &http.Request{TLS: &tls.ConnectionState{}}
+
+	if !settings.forRequest(r).Secure {
+		t.Fatalf("Cookie should be secure over TLS\n")
+	}
+	if settings.forRequest(&http.Request{}).Secure {
+		t.Fatalf("Cookie shouldn't be secure without TLS\n")
+	}
+}
@@ -0,0 +1,67 @@
+package statesman
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RateLimit configures a token bucket that allows Rate requests per second on
+// average and bursts of up to Burst requests. A zero Rate disables the limit.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// A token bucket, safe for use by several goroutines
+type rateLimiter struct {
+	limit  RateLimit
+	mutex  sync.Mutex
+	tokens float64
+	last   time.Time
+	// The current time, replaced by tests
+	now func() time.Time
+}
+
+// Return a limiter for the limit, nil if it's disabled
+func newRateLimiter(limit RateLimit) *rateLimiter {
+	if limit.Rate == 0 {
+		return nil
+	}
+	return &rateLimiter{limit: limit, tokens: float64(limit.Burst), last: time.Now(), now: time.Now}
+}
+
+// Take a token from the bucket. If the bucket is empty the request isn't
+// allowed and the time until a token is available is returned. A nil limiter
+// allows every request.
+func (limiter *rateLimiter) allow() (bool, time.Duration) {
+	if limiter == nil {
+		return true, 0
+	}
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	now := limiter.now()
+	elapsed := now.Sub(limiter.last).Seconds()
+	limiter.tokens = math.Min(float64(limiter.limit.Burst), limiter.tokens+elapsed*limiter.limit.Rate)
+	limiter.last = now
+
+	if limiter.tokens >= 1 {
+		limiter.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - limiter.tokens) / limiter.limit.Rate * float64(time.Second))
+}
+
+// Respond to a request that was rejected by a rate limit, telling the client
+// when to retry
+func (clr *Controller) rateLimited(w http.ResponseWriter, r *http.Request, retryAfter time.Duration) {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	clr.options.RateLimitHandler(w, r)
+}
@@ -0,0 +1,85 @@
+package statesman
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter_AllowsBurstThenRate(t *testing.T) {
+	now := time.Now()
+	limiter := newRateLimiter(RateLimit{Rate: 1, Burst: 2})
+	limiter.now = func() time.Time { return now }
+	limiter.last = now
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := limiter.allow(); !ok {
+			t.Fatalf("Expected the burst to be allowed\n")
+		}
+	}
+	if ok, retryAfter := limiter.allow(); ok || retryAfter != time.Second {
+		t.Fatalf("Expected to retry after a second got %v, %v\n", ok, retryAfter)
+	}
+
+	now = now.Add(500 * time.Millisecond)
+	if ok, retryAfter := limiter.allow(); ok || retryAfter != 500*time.Millisecond {
+		t.Fatalf("Expected to retry after half a second got %v, %v\n", ok, retryAfter)
+	}
+
+	now = now.Add(500 * time.Millisecond)
+	if ok, _ := limiter.allow(); !ok {
+		t.Fatalf("Expected a token to have been added\n")
+	}
+}
+
+func TestRateLimiter_NilAllowsEverything(t *testing.T) {
+	limiter := newRateLimiter(RateLimit{})
+	if limiter != nil {
+		t.Fatalf("Expected no limiter for a zero rate\n")
+	}
+	if ok, _ := limiter.allow(); !ok {
+		t.Fatalf("Expected a nil limiter to allow requests\n")
+	}
+}
+
+func TestSessionStart_RateLimitsNewSessions(t *testing.T) {
+	crl := newTestController(WithStartRateLimit(RateLimit{Rate: 0.1, Burst: 1}))
+	defer crl.Close()
+	firstHandler := crl.SessionStart(func(s *Session) {
+		s.First()
+	})
+
+	tc := newTestClient()
+	firstHandler(tc.w, tc.r)
+	tc = newTestClient()
+	firstHandler(tc.w, tc.r)
+
+	if tc.w.status != http.StatusTooManyRequests {
+		t.Fatalf("Expected %d got %d\n", http.StatusTooManyRequests, tc.w.status)
+	}
+	if retryAfter := tc.w.Header().Get("Retry-After"); retryAfter != "10" {
+		t.Fatalf("Expected to retry after 10 seconds got %s\n", retryAfter)
+	}
+}
+
+func TestSessionHandler_RateLimitsSessionRequests(t *testing.T) {
+	crl := newTestController(WithStepRateLimit(RateLimit{Rate: 0.1, Burst: 1}))
+	defer crl.Close()
+	firstHandler := crl.SessionStart(func(s *Session) {
+		w, _ := s.First()
+		for w != nil {
+			w, _ = s.Next()
+		}
+	})
+
+	tc := newTestClient()
+	<-tc.get(firstHandler)
+	<-tc.get(crl.SessionHandler())
+	if tc.w.status != 0 {
+		t.Fatalf("Expected the first request to be allowed got %d\n", tc.w.status)
+	}
+	<-tc.get(crl.SessionHandler())
+	if tc.w.status != http.StatusTooManyRequests || tc.w.Header().Get("Retry-After") == "" {
+		t.Fatalf("Expected the second request to be rate limited got %d\n", tc.w.status)
+	}
+}
@@ -1,52 +1,346 @@
 package statesman
 
 import (
+	"context"
+	"errors"
 	"net/http"
+	"sync"
+	"time"
 )
 
+// ErrSessionExpired is returned by Session.Err once the session has been
+// expired because no request arrived within the session timeout.
+var ErrSessionExpired = errors.New("Session expired.")
+
+// ErrSessionAborted is returned by Session.Err once the session has been
+// aborted, either by Session.Abort or by closing its Controller.
+var ErrSessionAborted = errors.New("Session aborted.")
+
+// ErrSessionFinished is returned by Session.Err once the session function has
+// returned. Requests that arrive after that are passed to the invalid session
+// handler with it as the reason.
+var ErrSessionFinished = errors.New("Session finished.")
+
 // Session stores the state of an individual session
 // Each session executes a single function that handles several http request.
 type Session struct {
-	// All HTTP requests are passed to internal HandleFunc. When the HandleFunc
-	// returns whatever data was written to the http.ResponseWriter gets sent as
-	// a response to the client. This channel is used to block the HandleFunc
-	// until the session has completed handling the request.
-	handlerGuard chan bool
 	// The session will receive the current HTTP request over this channel from
 	// one of the internal HandleFuncs.
 	httpRequestCh chan *httpRequest
+	// Holds a value while a request is admitted to the session so that
+	// concurrent requests are handled according to the Controller's
+	// ConcurrencyPolicy
+	slot chan struct{}
+	// The most recent request admitted or waiting to be admitted, for
+	// CancelOlderRequests
+	latestMutex sync.Mutex
+	latest      *admission
 	// The controller that owns this session
 	controller *Controller
+	// The key the session is registered under
+	key string
+	// The name of the workflow the session belongs to
+	workflow string
+	// Identifies the client that started the session for per-client
+	// session limits
+	client string
+	// Limits the rate of the session's requests, nil for no limit
+	limiter *rateLimiter
+	// The bound attributes of the client that started the session
+	fingerprint fingerprint
+	// The session token issued with the current request
+	token string
+	// The steps of the session that may be revisited, or only the current
+	// step unless keepHistory. The first step in the history is firstStep
+	// and it holds at most maxHistory steps.
+	historyMutex sync.Mutex
+	history      []*stepRecord
+	firstStep    int
+	keepHistory  bool
+	maxHistory   int
+	// The last request the session handled, for replaying its response to
+	// duplicates of it
+	last *handledRequest
+	// Whether the current request rewound the session and to which step
+	rewound   bool
+	rewoundTo int
+	// The CSRF token of the current step
+	csrfMutex sync.Mutex
+	csrfToken string
+	// How long to wait for a request before expiring the session. Zero
+	// disables the timeout.
+	timeout time.Duration
+	// Cancelled when the session ends
+	ctx    context.Context
+	cancel context.CancelFunc
+	// Closed once the session has ended so that HandleFuncs don't block
+	// trying to send it a request.
+	done    chan struct{}
+	endOnce sync.Once
+	// Why the session has ended, only valid once done is closed.
+	err error
+	// Whether the session ended because its function panicked, only valid
+	// once done is closed.
+	panicked bool
+	// The request whose HandleFunc is blocked waiting for the session to
+	// finish handling it, nil if there isn't one.
+	current *httpRequest
 }
 
 type httpRequest struct {
 	w http.ResponseWriter
 	r *http.Request
+	// The session token issued in the response
+	token string
+	// The CSRF token of the step, empty without CSRF protection
+	csrfToken string
+	// All HTTP requests are passed to internal HandleFunc. When the HandleFunc
+	// returns whatever data was written to the http.ResponseWriter gets sent as
+	// a response to the client. This channel is closed once the session has
+	// completed handling the request to unblock the HandleFunc.
+	served chan struct{}
+	// Closed if the client disconnects, nil if that can't be detected
+	disconnected <-chan struct{}
+	// The number of the step the request is for, -1 until the session
+	// accepts it
+	step int
+	// Rewind the session to a checkpoint before the step
+	rewind   bool
+	rewindTo int
+	// Identify duplicates of the request
+	method         string
+	path           string
+	stepToken      string
+	idempotencyKey string
+}
+
+func newHTTPRequest(w http.ResponseWriter, r *http.Request, token string, csrfToken string) *httpRequest {
+	request := &httpRequest{w: w, r: r, token: token, csrfToken: csrfToken, served: make(chan struct{}), step: -1}
+	if r != nil {
+		request.disconnected = r.Context().Done()
+	}
+	return request
+}
+
+func newSession(controller *Controller, key string) *Session {
+	ctx, cancel := context.WithCancel(context.Background())
+	maxHistory := controller.options.MaxHistory
+	if maxHistory == 0 {
+		maxHistory = DefaultMaxHistory
+	}
+	return &Session{
+		httpRequestCh: make(chan *httpRequest),
+		slot:          make(chan struct{}, 1),
+		controller:    controller,
+		key:           key,
+		timeout:       controller.options.SessionTimeout,
+		limiter:       newRateLimiter(controller.options.StepRateLimit),
+		maxHistory:    maxHistory,
+		ctx:           ctx,
+		cancel:        cancel,
+		done:          make(chan struct{}),
+	}
 }
 
-func (session *Session) blockHandler() {
-	<-session.handlerGuard
+// Wait for the session to finish handling the request, or for its client to
+// disconnect
+func (session *Session) blockHandler(request *httpRequest) {
+	select {
+	case <-request.served:
+	case <-request.disconnected:
+		// The session may still be writing the response
+		if writer, ok := request.w.(*responseWriter); ok {
+			writer.detach()
+		}
+	}
 }
 
+// Allow the HandleFunc of the current request to return
 func (session *Session) unblockHandler() {
-	session.handlerGuard <- true
+	if session.current == nil {
+		return
+	}
+	session.recordResponse()
+	if session.current.served != nil {
+		close(session.current.served)
+	}
+	session.current = nil
+}
+
+// End the session with the given reason. Only the first call to end or
+// endPanicked has any effect.
+func (session *Session) end(err error) {
+	session.endOnce.Do(func() {
+		session.stop(err)
+	})
+}
+
+// End the session because its function panicked, unless it has already ended
+func (session *Session) endPanicked() {
+	session.endOnce.Do(func() {
+		session.panicked = true
+		session.stop(ErrSessionAborted)
+	})
+}
+
+// Record why the session ended and signal that it has
+func (session *Session) stop(err error) {
+	session.err = err
+	if session.done != nil {
+		close(session.done)
+	}
+	if session.cancel != nil {
+		session.cancel()
+	}
+}
+
+// Expire the session and unregister it so no further requests are routed to
+// it.
+func (session *Session) expire() {
+	session.end(ErrSessionExpired)
+	if session.controller != nil {
+		session.controller.unregister(session.key)
+	}
+}
+
+// Wait for the next request, expiring the session if none arrives within the
+// session timeout. The request doesn't become a step until it's accepted.
+func (session *Session) receive(ctx context.Context) (*httpRequest, error) {
+	if err := session.Err(); err != nil {
+		return nil, err
+	}
+
+	var timeoutCh <-chan time.Time
+	if session.timeout > 0 {
+		timer := time.NewTimer(session.timeout)
+		defer timer.Stop()
+		timeoutCh = timer.C
+	}
+
+	select {
+	case request := <-session.httpRequestCh:
+		session.current = request
+		session.token = request.token
+		return request, nil
+	case <-timeoutCh:
+		session.expire()
+		return nil, session.err
+	case <-session.done:
+		return nil, session.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Make the received request the session's next step. A request that rewinds
+// to a checkpoint that's no longer in the history is answered out of sequence
+// instead.
+func (session *Session) accept(request *httpRequest) bool {
+	if !session.addStep(request) {
+		session.outOfSequence(request.w, request.r, nil)
+		session.unblockHandler()
+		return false
+	}
+	session.setCSRFToken(request.csrfToken)
+	return true
+}
+
+// Token returns the session token issued in the response to the current
+// request. Clients that don't use cookies need it to make the next request,
+// so a workflow can include it in the response body or in URLs.
+func (session *Session) Token() string {
+	return session.token
+}
+
+// RequestDone returns a channel that's closed if the current request is
+// cancelled, such as when its client disconnects or it's superseded by
+// CancelOlderRequests. The session function can then roll back the step or
+// carry on and wait for the client to retry it. It's nil before the first
+// request and after the current request has been handled.
+func (session *Session) RequestDone() <-chan struct{} {
+	if session.current == nil || session.current.r == nil {
+		return nil
+	}
+	return session.current.r.Context().Done()
+}
+
+// RequestErr returns nil while the current request is active,
+// ErrClientDisconnected once its client has disconnected, or the error of the
+// request's context if it was cancelled for another reason.
+func (session *Session) RequestErr() error {
+	if session.current == nil || session.current.r == nil {
+		return nil
+	}
+	select {
+	case <-session.current.disconnected:
+		return ErrClientDisconnected
+	default:
+		return session.current.r.Context().Err()
+	}
+}
+
+// Context returns the session's context. It's cancelled when the session
+// expires, is aborted, finishes or its Controller is closed.
+func (session *Session) Context() context.Context {
+	return session.ctx
+}
+
+// Abort ends the session. Any pending or future calls to First or Next
+// return immediately and Err returns ErrSessionAborted. Abort may be called
+// from any goroutine.
+func (session *Session) Abort() {
+	session.end(ErrSessionAborted)
+}
+
+// Err returns nil while the session is running, otherwise the reason it
+// ended (ErrSessionExpired, ErrSessionAborted or ErrSessionFinished).
+func (session *Session) Err() error {
+	select {
+	case <-session.done:
+		return session.err
+	default:
+		return nil
+	}
 }
 
 // First returns the request and response data for the HTTP request that started the
 // session.
 func (session *Session) First() (w http.ResponseWriter, r *http.Request) {
-	request := <-session.httpRequestCh
-	return request.w, request.r
+	w, r, _ = session.FirstContext(context.Background())
+	return w, r
+}
+
+// FirstContext is like First but also returns early with ctx.Err() if ctx is
+// done, or with the reason the session ended.
+func (session *Session) FirstContext(ctx context.Context) (w http.ResponseWriter, r *http.Request, err error) {
+	for {
+		request, err := session.receive(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		if session.accept(request) {
+			return request.w, request.r, nil
+		}
+	}
 }
 
 // Next returns the request and response data for the named HTTP request
-// It blocks until the HTTP request is received.
+// It blocks until the HTTP request is received. If the session ends before a
+// request arrives Next returns a nil http.ResponseWriter and http.Request.
 func (session *Session) Next() (w http.ResponseWriter, r *http.Request) {
+	w, r, _ = session.NextContext(context.Background())
+	return w, r
+}
+
+// NextContext is like Next but also returns early with ctx.Err() if ctx is
+// done, or with the reason the session ended. A session whose NextContext
+// returned because ctx was done can still receive further requests.
+func (session *Session) NextContext(ctx context.Context) (w http.ResponseWriter, r *http.Request, err error) {
 	// When the session is asking for the next HTTP request we know that the
 	// previous HTTP request has been handled. Allow the previous HandleFunc to
 	// finish, which will cause the previous HTTP request's response to be sent
 	// to the client.
 	session.unblockHandler()
 
-	return session.First()
+	return session.FirstContext(ctx)
 }
@@ -1,9 +1,10 @@
 package statesman
 
 import (
+	"context"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
-	"strings"
 	"testing"
 	"time"
 )
@@ -45,17 +46,15 @@ func (ts *testClient) init() {
 }
 
 func (ts *testClient) get(handler func(w http.ResponseWriter, r *http.Request)) chan bool {
-	sessionKey := ""
+	var cookies []*http.Cookie
 	if ts.w != nil {
-		cookies := ts.w.Header()["Set-Cookie"]
-		if len(cookies) != 0 {
-			cookie := cookies[0]
-			sessionKey = strings.Split(cookie, "=")[0]
-		}
+		cookies = (&http.Response{Header: ts.w.Header()}).Cookies()
 	}
 	ts.init()
-	if sessionKey != "" {
-		ts.r.AddCookie(generateSessionCookie(sessionKey, "", time.Minute*10))
+	for _, cookie := range cookies {
+		if cookie.MaxAge >= 0 {
+			ts.r.AddCookie(&http.Cookie{Name: cookie.Name, Value: cookie.Value})
+		}
 	}
 	doneCh := make(chan bool)
 	go func() {
@@ -65,8 +64,28 @@ func (ts *testClient) get(handler func(w http.ResponseWriter, r *http.Request))
 	return doneCh
 }
 
+// Start a session with the session function and return the cookies issued in
+// the response to its first request
+func startTestSession(crl *Controller, sessionHandler func(s *Session)) []*http.Cookie {
+	w := httptest.NewRecorder()
+	crl.SessionStart(sessionHandler)(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	return w.Result().Cookies()
+}
+
+// Send the request with the cookies to the session handler and return the
+// response
+func sendTestRequest(crl *Controller, r *http.Request, cookies []*http.Cookie) *httptest.ResponseRecorder {
+	for _, cookie := range cookies {
+		r.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	crl.SessionHandler()(w, r)
+	return w
+}
+
 func TestBlockHandler_WaitsForCallToUnblockHandler(t *testing.T) {
-	session := Session{handlerGuard: make(chan bool)}
+	previous := newHTTPRequest(nil, nil, "", "")
+	session := Session{current: previous}
 	sequencerA := make(chan int, 4)
 	sequencerB := make(chan int, 4)
 
@@ -76,7 +95,7 @@ func TestBlockHandler_WaitsForCallToUnblockHandler(t *testing.T) {
 		sequencerB <- 1
 	}()
 	sequencerB <- 0
-	session.blockHandler()
+	session.blockHandler(previous)
 	sequencerA <- 1
 
 	if <-sequencerA != 0 {
@@ -98,7 +117,7 @@ func TestFirst_RetrievesFirstRequest(t *testing.T) {
 	session := &Session{httpRequestCh: make(chan *httpRequest)}
 
 	go func() {
-		session.httpRequestCh <- &httpRequest{tc.w, tc.r}
+		session.httpRequestCh <- &httpRequest{w: tc.w, r: tc.r}
 	}()
 
 	w, r := session.First()
@@ -114,16 +133,17 @@ func TestFirst_RetrievesFirstRequest(t *testing.T) {
 
 func TestNext_NotifiesThatPreviousRequestHasBeenServiced(t *testing.T) {
 	tc := newTestClient()
+	previous := newHTTPRequest(nil, nil, "", "")
 	session := Session{
-		handlerGuard:  make(chan bool),
 		httpRequestCh: make(chan *httpRequest),
+		current:       previous,
 	}
 	sequencerA := make(chan int, 4)
 
 	go func() {
-		session.blockHandler()
+		session.blockHandler(previous)
 		sequencerA <- 0
-		session.httpRequestCh <- &httpRequest{tc.w, tc.r}
+		session.httpRequestCh <- &httpRequest{w: tc.w, r: tc.r}
 	}()
 
 	session.Next()
@@ -134,14 +154,15 @@ func TestNext_NotifiesThatPreviousRequestHasBeenServiced(t *testing.T) {
 
 func TestNext_ReceivesNextRequest(t *testing.T) {
 	tc := newTestClient()
+	previous := newHTTPRequest(nil, nil, "", "")
 	session := Session{
-		handlerGuard:  make(chan bool),
 		httpRequestCh: make(chan *httpRequest),
+		current:       previous,
 	}
 
 	go func() {
-		session.blockHandler()
-		session.httpRequestCh <- &httpRequest{tc.w, tc.r}
+		session.blockHandler(previous)
+		session.httpRequestCh <- &httpRequest{w: tc.w, r: tc.r}
 	}()
 
 	w, r := session.Next()
@@ -154,3 +175,89 @@ func TestNext_ReceivesNextRequest(t *testing.T) {
 		t.Fatalf("Didn't get the expected Request\n")
 	}
 }
+
+func TestFirst_ExpiresAfterTimeout(t *testing.T) {
+	session := &Session{
+		httpRequestCh: make(chan *httpRequest),
+		timeout:       time.Millisecond,
+		done:          make(chan struct{}),
+	}
+
+	w, r := session.First()
+
+	if w != nil || r != nil {
+		t.Fatalf("Expired session shouldn't return a request\n")
+	}
+	if session.Err() != ErrSessionExpired {
+		t.Fatalf("Expected ErrSessionExpired got %v\n", session.Err())
+	}
+	select {
+	case <-session.done:
+	default:
+		t.Fatalf("Expired session should be done\n")
+	}
+}
+
+func TestNext_ReturnsImmediatelyOnceExpired(t *testing.T) {
+	session := &Session{done: make(chan struct{})}
+	session.end(ErrSessionExpired)
+
+	w, r := session.Next()
+
+	if w != nil || r != nil {
+		t.Fatalf("Expired session shouldn't return a request\n")
+	}
+}
+
+func TestNextContext_ReturnsContextError(t *testing.T) {
+	session := &Session{httpRequestCh: make(chan *httpRequest)}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	w, r, err := session.NextContext(ctx)
+
+	if w != nil || r != nil {
+		t.Fatalf("Cancelled NextContext shouldn't return a request\n")
+	}
+	if err != context.Canceled {
+		t.Fatalf("Expected context.Canceled got %v\n", err)
+	}
+	if session.Err() != nil {
+		t.Fatalf("Cancelling NextContext shouldn't end the session\n")
+	}
+}
+
+func TestAbort_EndsSessionAndCancelsContext(t *testing.T) {
+	crl := newTestController()
+	defer crl.Close()
+	session := newSession(crl, "key")
+	aborted := make(chan error)
+
+	go func() {
+		_, _, err := session.NextContext(context.Background())
+		aborted <- err
+	}()
+	session.Abort()
+
+	if err := <-aborted; err != ErrSessionAborted {
+		t.Fatalf("Expected ErrSessionAborted got %v\n", err)
+	}
+	if session.Err() != ErrSessionAborted {
+		t.Fatalf("Expected ErrSessionAborted got %v\n", session.Err())
+	}
+	if session.Context().Err() != context.Canceled {
+		t.Fatalf("Session context wasn't cancelled\n")
+	}
+}
+
+func TestExpire_CancelsContext(t *testing.T) {
+	crl := newTestController(WithSessionTimeout(time.Millisecond), WithInvalidSessionHandler(DefaultInvalidSessionHandler))
+	defer crl.Close()
+	session := newSession(crl, "key")
+
+	session.First()
+
+	if session.Context().Err() != context.Canceled {
+		t.Fatalf("Session context wasn't cancelled\n")
+	}
+}
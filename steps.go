@@ -0,0 +1,206 @@
+package statesman
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// The context key of the paths a session was waiting for
+type expectedPathsKey struct{}
+
+// ExpectedPaths returns the paths the session of a request passed to the out
+// of sequence handler was waiting for. It's empty if the session was waiting
+// for requests matching some other condition. The paths are as the session
+// sees them, so for a mounted workflow they're relative to its MountPrefix.
+func ExpectedPaths(r *http.Request) []string {
+	paths, _ := r.Context().Value(expectedPathsKey{}).([]string)
+	return paths
+}
+
+// OutOfSequenceRedirect returns an out of sequence handler that redirects the
+// client to the first path the session is waiting for with the given status
+// code. A request that is already for that path, for example with the wrong
+// method, gets a 409 Conflict instead so that the client isn't redirected in a
+// loop.
+func OutOfSequenceRedirect(code int) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		paths := ExpectedPaths(r)
+		if len(paths) == 0 || paths[0] == r.URL.Path {
+			DefaultOutOfSequenceHandler(w, r)
+			return
+		}
+		http.Redirect(w, r, MountPrefix(r)+paths[0], code)
+	}
+}
+
+// Respond to a request that the session wasn't waiting for
+func (session *Session) outOfSequence(w http.ResponseWriter, r *http.Request, paths []string) {
+	handler := DefaultOutOfSequenceHandler
+	if session.controller != nil {
+		handler = session.controller.options.OutOfSequenceHandler
+	}
+	if paths != nil {
+		r = r.WithContext(context.WithValue(r.Context(), expectedPathsKey{}, paths))
+	}
+	handler(w, r)
+}
+
+// Wait for a request that matches, answering any others with the out of
+// sequence handler
+func (session *Session) nextMatching(ctx context.Context, match func(r *http.Request) bool, paths []string) (w http.ResponseWriter, r *http.Request, err error) {
+	for {
+		session.unblockHandler()
+		request, err := session.receive(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		// An unexpected request isn't a step, so it doesn't replace the
+		// step's token or CSRF token
+		if !match(request.r) {
+			session.outOfSequence(request.w, request.r, paths)
+		} else if session.accept(request) {
+			return request.w, request.r, nil
+		}
+	}
+}
+
+// NextMatching is like Next but only returns requests for which match returns
+// true. Other requests are answered by the out of sequence handler without
+// being passed to the session function.
+func (session *Session) NextMatching(match func(r *http.Request) bool) (w http.ResponseWriter, r *http.Request) {
+	w, r, _ = session.NextMatchingContext(context.Background(), match)
+	return w, r
+}
+
+// NextMatchingContext is like NextMatching but also returns early with
+// ctx.Err() if ctx is done, or with the reason the session ended.
+func (session *Session) NextMatchingContext(ctx context.Context, match func(r *http.Request) bool) (w http.ResponseWriter, r *http.Request, err error) {
+	return session.nextMatching(ctx, match, nil)
+}
+
+// Return a predicate that matches requests with the method, or any method if
+// it's empty, for one of the paths
+func matchRequest(method string, paths []string) func(r *http.Request) bool {
+	return func(r *http.Request) bool {
+		if method != "" && r.Method != method {
+			return false
+		}
+		for _, path := range paths {
+			if r.URL.Path == path {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// NextPath is like Next but only returns requests for one of the paths. Other
+// requests are answered by the out of sequence handler, which can find the
+// paths with ExpectedPaths.
+func (session *Session) NextPath(paths ...string) (w http.ResponseWriter, r *http.Request) {
+	return session.NextRequest("", paths...)
+}
+
+// NextRequest is like NextPath but also only returns requests with the given
+// method.
+func (session *Session) NextRequest(method string, paths ...string) (w http.ResponseWriter, r *http.Request) {
+	w, r, _ = session.nextMatching(context.Background(), matchRequest(method, paths), paths)
+	return w, r
+}
+
+// Case is one of the steps a session can wait for with Select. A request case
+// matches requests with its Method, or any method if it's empty, for its Path
+// unless it has a Match function. A timeout case, one with a Timeout, is
+// selected if no request case is selected within the timeout.
+type Case struct {
+	Method string
+	Path   string
+	Match  func(r *http.Request) bool
+	// Makes the case a timeout case
+	Timeout time.Duration
+	// Called when the case is selected, with a nil http.ResponseWriter and
+	// http.Request for a timeout case. Optional.
+	Do func(w http.ResponseWriter, r *http.Request)
+}
+
+// OnRequest returns a case for requests with the method, or any method if
+// it's empty, for the path.
+func OnRequest(method string, path string, do func(w http.ResponseWriter, r *http.Request)) Case {
+	return Case{Method: method, Path: path, Do: do}
+}
+
+// OnTimeout returns a case that's selected if no request case is selected
+// within the timeout.
+func OnTimeout(timeout time.Duration, do func()) Case {
+	c := Case{Timeout: timeout}
+	if do != nil {
+		c.Do = func(http.ResponseWriter, *http.Request) { do() }
+	}
+	return c
+}
+
+// Whether the case matches the request
+func (c *Case) matches(r *http.Request) bool {
+	if c.Timeout != 0 {
+		return false
+	}
+	if c.Match != nil {
+		return c.Match(r)
+	}
+	return matchRequest(c.Method, []string{c.Path})(r)
+}
+
+// Select waits for the next request that matches one of the cases and calls
+// the case's Do function. Other requests are answered by the out of sequence
+// handler. It returns the index of the selected case, with the request for a
+// request case. If the session ends first Select returns -1.
+func (session *Session) Select(cases ...Case) (int, http.ResponseWriter, *http.Request) {
+	selected, w, r, _ := session.SelectContext(context.Background(), cases...)
+	return selected, w, r
+}
+
+// SelectContext is like Select but also returns -1 and ctx.Err() if ctx is
+// done, or the reason the session ended.
+func (session *Session) SelectContext(ctx context.Context, cases ...Case) (int, http.ResponseWriter, *http.Request, error) {
+	// The earliest timeout case is selected
+	timeoutCase := -1
+	var paths []string
+	for i := range cases {
+		if cases[i].Timeout == 0 {
+			if cases[i].Match == nil {
+				paths = append(paths, cases[i].Path)
+			}
+		} else if timeoutCase == -1 || cases[i].Timeout < cases[timeoutCase].Timeout {
+			timeoutCase = i
+		}
+	}
+	waitCtx := ctx
+	if timeoutCase != -1 {
+		var cancel context.CancelFunc
+		waitCtx, cancel = context.WithTimeout(ctx, cases[timeoutCase].Timeout)
+		defer cancel()
+	}
+
+	selected := -1
+	w, r, err := session.nextMatching(waitCtx, func(r *http.Request) bool {
+		for i := range cases {
+			if cases[i].matches(r) {
+				selected = i
+				return true
+			}
+		}
+		return false
+	}, paths)
+
+	if err == context.DeadlineExceeded && timeoutCase != -1 && ctx.Err() == nil {
+		selected, err = timeoutCase, nil
+	}
+	if err != nil {
+		return -1, nil, nil, err
+	}
+	if cases[selected].Do != nil {
+		cases[selected].Do(w, r)
+	}
+	return selected, w, r, nil
+}
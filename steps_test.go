@@ -0,0 +1,219 @@
+package statesman
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func newStepRequest(method string, path string) *http.Request {
+	return &http.Request{Method: method, URL: &url.URL{Path: path}, Header: http.Header{}}
+}
+
+// Start a session that calls the session function once it has received its
+// first request and return a function that sends requests to it
+func startStepSession(crl *Controller, sessionHandler func(s *Session)) func(r *http.Request) *httptest.ResponseRecorder {
+	cookies := startTestSession(crl, func(s *Session) {
+		s.First()
+		sessionHandler(s)
+	})
+	return func(r *http.Request) *httptest.ResponseRecorder {
+		return sendTestRequest(crl, r, cookies)
+	}
+}
+
+func TestMatchRequest_MatchesMethodAndPaths(t *testing.T) {
+	match := matchRequest(http.MethodPost, []string{"/a", "/b"})
+	if !match(newStepRequest(http.MethodPost, "/b")) {
+		t.Fatalf("Expected the request to match\n")
+	}
+	if match(newStepRequest(http.MethodGet, "/b")) || match(newStepRequest(http.MethodPost, "/c")) {
+		t.Fatalf("Expected the request not to match\n")
+	}
+	if !matchRequest("", []string{"/a"})(newStepRequest(http.MethodGet, "/a")) {
+		t.Fatalf("Expected any method to match\n")
+	}
+}
+
+func TestNextPath_AnswersUnexpectedRequestsOutOfSequence(t *testing.T) {
+	expected := make(chan []string, 1)
+	crl := newTestController(WithOutOfSequenceHandler(func(w http.ResponseWriter, r *http.Request) {
+		expected <- ExpectedPaths(r)
+		DefaultOutOfSequenceHandler(w, r)
+	}))
+	defer crl.Close()
+	paths := make(chan string, 1)
+	send := startStepSession(crl, func(s *Session) {
+		w, r := s.NextPath("/next", "/other")
+		paths <- r.URL.Path
+		w.WriteHeader(http.StatusOK)
+		s.Next()
+	})
+
+	if w := send(newStepRequest(http.MethodGet, "/unexpected")); w.Code != http.StatusConflict {
+		t.Fatalf("Expected %d got %d\n", http.StatusConflict, w.Code)
+	}
+	if paths := <-expected; len(paths) != 2 || paths[0] != "/next" || paths[1] != "/other" {
+		t.Fatalf("Expected the paths the session was waiting for got %v\n", paths)
+	}
+	if w := send(newStepRequest(http.MethodGet, "/other")); w.Code != http.StatusOK {
+		t.Fatalf("Expected %d got %d\n", http.StatusOK, w.Code)
+	}
+	if path := <-paths; path != "/other" {
+		t.Fatalf("Expected the matching request got %s\n", path)
+	}
+}
+
+func TestNextMatching_KeepsTheStepsCSRFToken(t *testing.T) {
+	crl := newTestController(WithCSRFProtection())
+	defer crl.Close()
+	csrfTokens := make(chan string, 1)
+	send := startStepSession(crl, func(s *Session) {
+		csrfTokens <- s.CSRFToken()
+		w, _ := s.NextMatching(func(r *http.Request) bool {
+			return r.Method == http.MethodPost
+		})
+		csrfTokens <- s.CSRFToken()
+		w.WriteHeader(http.StatusOK)
+		s.Next()
+	})
+	first := <-csrfTokens
+
+	if w := send(newStepRequest(http.MethodGet, "/next")); w.Code != http.StatusConflict {
+		t.Fatalf("Expected %d got %d\n", http.StatusConflict, w.Code)
+	}
+
+	r := newStepRequest(http.MethodPost, "/next")
+	r.Header.Set(CSRFHeader, first)
+	if w := send(r); w.Code != http.StatusOK {
+		t.Fatalf("Expected the step's CSRF token to be accepted got %d\n", w.Code)
+	}
+	if second := <-csrfTokens; second == first {
+		t.Fatalf("Expected a new CSRF token for the next step\n")
+	}
+}
+
+func TestNextPath_KeepsTheStepsStepToken(t *testing.T) {
+	crl := newTestController(WithPastStepPolicy(RejectPastSteps))
+	defer crl.Close()
+	stepTokens := make(chan string, 1)
+	send := startStepSession(crl, func(s *Session) {
+		stepTokens <- s.StepToken()
+		w, _ := s.NextPath("/confirm")
+		w.WriteHeader(http.StatusOK)
+		s.Next()
+	})
+	stepToken := <-stepTokens
+
+	if w := send(newStepRequest(http.MethodGet, "/other")); w.Code != http.StatusConflict {
+		t.Fatalf("Expected %d got %d\n", http.StatusConflict, w.Code)
+	}
+
+	// The page of the step is still the current step
+	r := newStepRequest(http.MethodGet, "/confirm")
+	r.Header.Set(StepHeader, stepToken)
+	if w := send(r); w.Code != http.StatusOK {
+		t.Fatalf("Expected the step's token to be accepted got %d\n", w.Code)
+	}
+}
+
+func TestOutOfSequenceRedirect_RedirectsToExpectedPath(t *testing.T) {
+	crl := newTestController(WithOutOfSequenceHandler(OutOfSequenceRedirect(http.StatusSeeOther)))
+	defer crl.Close()
+	send := startStepSession(crl, func(s *Session) {
+		s.NextRequest(http.MethodPost, "/next")
+	})
+
+	w := send(newStepRequest(http.MethodGet, "/unexpected"))
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/next" {
+		t.Fatalf("Expected a redirect to /next got %d %v\n", w.Code, w.Header())
+	}
+
+	// Redirecting to the same path would loop
+	w = send(newStepRequest(http.MethodGet, "/next"))
+	if w.Code != http.StatusConflict {
+		t.Fatalf("Expected %d got %d\n", http.StatusConflict, w.Code)
+	}
+}
+
+func TestSelect_DispatchesToMatchingCase(t *testing.T) {
+	crl := newTestController()
+	defer crl.Close()
+	selected := make(chan int, 1)
+	send := startStepSession(crl, func(s *Session) {
+		for {
+			i, w, _ := s.Select(
+				OnRequest(http.MethodPost, "/confirm", func(w http.ResponseWriter, r *http.Request) {
+					w.WriteHeader(http.StatusCreated)
+				}),
+				OnRequest("", "/back", func(w http.ResponseWriter, r *http.Request) {
+					w.WriteHeader(http.StatusAccepted)
+				}),
+				Case{Match: func(r *http.Request) bool { return r.URL.Path == "/cancel" }},
+			)
+			if w == nil {
+				return
+			}
+			selected <- i
+		}
+	})
+
+	steps := []struct {
+		r        *http.Request
+		status   int
+		selected int
+	}{
+		{newStepRequest(http.MethodPost, "/confirm"), http.StatusCreated, 0},
+		{newStepRequest(http.MethodGet, "/back"), http.StatusAccepted, 1},
+		{newStepRequest(http.MethodGet, "/cancel"), http.StatusOK, 2},
+	}
+	for _, step := range steps {
+		if w := send(step.r); w.Code != step.status {
+			t.Fatalf("Expected %d got %d\n", step.status, w.Code)
+		}
+		if i := <-selected; i != step.selected {
+			t.Fatalf("Expected case %d got %d\n", step.selected, i)
+		}
+	}
+
+	if w := send(newStepRequest(http.MethodGet, "/confirm")); w.Code != http.StatusConflict {
+		t.Fatalf("Expected an unmatched request to be out of sequence got %d\n", w.Code)
+	}
+}
+
+func TestSelect_SelectsTimeoutCase(t *testing.T) {
+	crl := newTestController()
+	defer crl.Close()
+	selected := make(chan int, 1)
+	timedOut := make(chan bool, 1)
+	startStepSession(crl, func(s *Session) {
+		i, w, r := s.Select(
+			OnRequest("", "/confirm", nil),
+			OnTimeout(time.Hour, nil),
+			OnTimeout(time.Millisecond, func() { timedOut <- true }),
+		)
+		if w != nil || r != nil {
+			t.Errorf("Expected no request for a timeout case\n")
+		}
+		selected <- i
+	})
+
+	if i := <-selected; i != 2 {
+		t.Fatalf("Expected the earliest timeout case got %d\n", i)
+	}
+	<-timedOut
+}
+
+func TestSelectContext_ReturnsContextError(t *testing.T) {
+	session := &Session{httpRequestCh: make(chan *httpRequest)}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	i, _, _, err := session.SelectContext(ctx, OnRequest("", "/confirm", nil), OnTimeout(time.Hour, nil))
+	if i != -1 || err != context.Canceled {
+		t.Fatalf("Expected -1 and %v got %d and %v\n", context.Canceled, i, err)
+	}
+}
@@ -0,0 +1,156 @@
+package statesman
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"time"
+)
+
+// ErrTokenInvalid is the invalid session reason for a session token that
+// couldn't be verified or decrypted, such as a forged or tampered token.
+var ErrTokenInvalid = errors.New("Invalid session token.")
+
+// ErrTokenExpired is the invalid session reason for a verified session token
+// that was issued longer than the session timeout ago.
+var ErrTokenExpired = errors.New("Session token expired.")
+
+const (
+	// The size of the issue time at the start of a token's payload
+	issuedAtSize = 8
+)
+
+var tokenEncoding = base64.RawURLEncoding
+
+// tokenCodec converts between session keys and the tokens sent to clients.
+// Without any keys the token is the session key itself. With signing keys the
+// token carries an HMAC-SHA256 signature and with encryption keys the session
+// key is sealed with AES-GCM. The first key of each is used to issue tokens
+// while all of them are accepted, which allows keys to be rotated.
+type tokenCodec struct {
+	signingKeys [][]byte
+	aeads       []cipher.AEAD
+	maxAge      time.Duration
+}
+
+func newTokenCodec(options *Options) (*tokenCodec, error) {
+	codec := &tokenCodec{signingKeys: options.SigningKeys, maxAge: options.SessionTimeout}
+	for _, key := range options.EncryptionKeys {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		codec.aeads = append(codec.aeads, aead)
+	}
+	return codec, nil
+}
+
+// Whether tokens are verified before the session registry is consulted
+func (codec *tokenCodec) verifies() bool {
+	return len(codec.signingKeys) != 0 || len(codec.aeads) != 0
+}
+
+func sign(key []byte, payload string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(payload))
+	return tokenEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Encode the session key as a token
+func (codec *tokenCodec) encode(sessionKey string) string {
+	if !codec.verifies() {
+		return sessionKey
+	}
+
+	payload := make([]byte, issuedAtSize, issuedAtSize+len(sessionKey))
+	binary.BigEndian.PutUint64(payload, uint64(time.Now().UnixNano()))
+	payload = append(payload, sessionKey...)
+
+	if len(codec.aeads) != 0 {
+		aead := codec.aeads[0]
+		nonce := make([]byte, aead.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			panic(err)
+		}
+		payload = aead.Seal(nonce, nonce, payload, nil)
+	}
+
+	token := tokenEncoding.EncodeToString(payload)
+	if len(codec.signingKeys) != 0 {
+		token += "." + sign(codec.signingKeys[0], token)
+	}
+	return token
+}
+
+// Decode a token into its session key, returning ErrTokenInvalid or
+// ErrTokenExpired if it can't be trusted.
+func (codec *tokenCodec) decode(token string) (string, error) {
+	if !codec.verifies() {
+		return token, nil
+	}
+
+	if len(codec.signingKeys) != 0 {
+		i := strings.LastIndexByte(token, '.')
+		if i == -1 {
+			return "", ErrTokenInvalid
+		}
+		signature := token[i+1:]
+		token = token[:i]
+
+		verified := false
+		for _, key := range codec.signingKeys {
+			if hmac.Equal([]byte(signature), []byte(sign(key, token))) {
+				verified = true
+				break
+			}
+		}
+		if !verified {
+			return "", ErrTokenInvalid
+		}
+	}
+
+	payload, err := tokenEncoding.DecodeString(token)
+	if err != nil {
+		return "", ErrTokenInvalid
+	}
+
+	if len(codec.aeads) != 0 {
+		payload, err = codec.open(payload)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if len(payload) <= issuedAtSize {
+		return "", ErrTokenInvalid
+	}
+	issuedAt := time.Unix(0, int64(binary.BigEndian.Uint64(payload)))
+	if time.Since(issuedAt) > codec.maxAge {
+		return "", ErrTokenExpired
+	}
+	return string(payload[issuedAtSize:]), nil
+}
+
+// Decrypt the payload with any of the encryption keys
+func (codec *tokenCodec) open(payload []byte) ([]byte, error) {
+	for _, aead := range codec.aeads {
+		if len(payload) < aead.NonceSize() {
+			continue
+		}
+		nonce, sealed := payload[:aead.NonceSize()], payload[aead.NonceSize():]
+		if opened, err := aead.Open(nil, nonce, sealed, nil); err == nil {
+			return opened, nil
+		}
+	}
+	return nil, ErrTokenInvalid
+}
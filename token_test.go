@@ -0,0 +1,101 @@
+package statesman
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+var (
+	testSigningKey0    = bytes.Repeat([]byte{0}, 32)
+	testSigningKey1    = bytes.Repeat([]byte{1}, 32)
+	testEncryptionKey0 = bytes.Repeat([]byte{2}, 32)
+	testEncryptionKey1 = bytes.Repeat([]byte{3}, 16)
+)
+
+func newTestTokenCodec(opts ...Option) *tokenCodec {
+	options := DefaultOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+	codec, err := newTokenCodec(&options)
+	assertNoError(err)
+	return codec
+}
+
+func TestTokenCodec_PlainTokenIsSessionKey(t *testing.T) {
+	codec := newTestTokenCodec()
+
+	if token := codec.encode("key"); token != "key" {
+		t.Fatalf("Expected the session key got %s\n", token)
+	}
+}
+
+func TestTokenCodec_RoundTrips(t *testing.T) {
+	codecs := []*tokenCodec{
+		newTestTokenCodec(WithSigningKeys(testSigningKey0)),
+		newTestTokenCodec(WithEncryptionKeys(testEncryptionKey0)),
+		newTestTokenCodec(WithSigningKeys(testSigningKey0), WithEncryptionKeys(testEncryptionKey0)),
+	}
+
+	key := generateUniqueString(32)
+	for _, codec := range codecs {
+		token := codec.encode(key)
+		if strings.Contains(token, key) && len(codec.aeads) != 0 {
+			t.Fatalf("Encrypted token shouldn't contain the session key\n")
+		}
+		sessionKey, err := codec.decode(token)
+		if err != nil || sessionKey != key {
+			t.Fatalf("Expected the session key got %s, %v\n", sessionKey, err)
+		}
+	}
+}
+
+func TestTokenCodec_RejectsTamperedTokens(t *testing.T) {
+	codecs := []*tokenCodec{
+		newTestTokenCodec(WithSigningKeys(testSigningKey0)),
+		newTestTokenCodec(WithEncryptionKeys(testEncryptionKey0)),
+	}
+
+	for _, codec := range codecs {
+		token := []byte(codec.encode("key"))
+		// Flip a character in the payload
+		if token[1] == 'A' {
+			token[1] = 'B'
+		} else {
+			token[1] = 'A'
+		}
+		for _, tampered := range []string{string(token), "", "garbage", "a.b"} {
+			if _, err := codec.decode(tampered); err != ErrTokenInvalid {
+				t.Fatalf("Expected ErrTokenInvalid for %s got %v\n", tampered, err)
+			}
+		}
+	}
+}
+
+func TestTokenCodec_RejectsExpiredTokens(t *testing.T) {
+	codec := newTestTokenCodec(WithSigningKeys(testSigningKey0), WithSessionTimeout(time.Millisecond))
+	token := codec.encode("key")
+	time.Sleep(5 * time.Millisecond)
+
+	if _, err := codec.decode(token); err != ErrTokenExpired {
+		t.Fatalf("Expected ErrTokenExpired got %v\n", err)
+	}
+}
+
+func TestTokenCodec_AcceptsRotatedKeys(t *testing.T) {
+	oldCodec := newTestTokenCodec(WithSigningKeys(testSigningKey0), WithEncryptionKeys(testEncryptionKey0))
+	newCodec := newTestTokenCodec(
+		WithSigningKeys(testSigningKey1, testSigningKey0),
+		WithEncryptionKeys(testEncryptionKey1, testEncryptionKey0),
+	)
+
+	sessionKey, err := newCodec.decode(oldCodec.encode("key"))
+	if err != nil || sessionKey != "key" {
+		t.Fatalf("Expected the session key got %s, %v\n", sessionKey, err)
+	}
+	if _, err := oldCodec.decode(newCodec.encode("key")); err != ErrTokenInvalid {
+		t.Fatalf("Expected ErrTokenInvalid got %v\n", err)
+	}
+}
@@ -0,0 +1,284 @@
+package statesman
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// SessionTokenHeader is the response header that carries the session token
+// for transports that can't issue it in the channel they read it from.
+const SessionTokenHeader = "Statesman-Session"
+
+// SessionTransport carries session tokens between clients and a Controller.
+type SessionTransport interface {
+	// Extract returns the session token carried by the request. It returns
+	// ErrNoSession if there isn't one, any other error is passed to the
+	// invalid session handler as the reason the request was rejected.
+	Extract(r *http.Request) (string, error)
+	// Issue sends the session token to the client in the response to r. The
+	// token is valid for ttl.
+	Issue(w http.ResponseWriter, r *http.Request, token string, ttl time.Duration) error
+}
+
+// Implemented by transports that can carry several candidate tokens, such as
+// cookies with the same name for different paths.
+type multiExtractor interface {
+	extractAll(r *http.Request) ([]string, error)
+}
+
+// Implemented by transports that keep the tokens of each workflow apart
+type scopedTransport interface {
+	scope(workflow string) SessionTransport
+}
+
+// Implemented by transports that carry the session token in the request's URL
+// so that it can be removed before the request is passed to the session.
+type requestRewriter interface {
+	rewrite(r *http.Request) *http.Request
+}
+
+// Return all of the tokens carried by the request
+func extractAll(transport SessionTransport, r *http.Request) ([]string, error) {
+	if extractor, ok := transport.(multiExtractor); ok {
+		return extractor.extractAll(r)
+	}
+	token, err := transport.Extract(r)
+	if err != nil {
+		return nil, err
+	}
+	return []string{token}, nil
+}
+
+// Return the transport for the named workflow's sessions
+func scopeTransport(transport SessionTransport, workflow string) SessionTransport {
+	if scoped, ok := transport.(scopedTransport); ok {
+		return scoped.scope(workflow)
+	}
+	return transport
+}
+
+// Remove the session token from the request's URL
+func rewriteRequest(transport SessionTransport, r *http.Request) *http.Request {
+	if rewriter, ok := transport.(requestRewriter); ok {
+		return rewriter.rewrite(r)
+	}
+	return r
+}
+
+// CookieTransport carries the session token in a cookie. It's the default
+// transport. Each workflow has its own cookie named after the CookieSettings'
+// name and the workflow's name.
+type CookieTransport struct {
+	Settings CookieSettings
+	// Also accept session tokens from cookies in the legacy
+	// "Statesman-<key>" format for the default workflow
+	AcceptLegacy bool
+}
+
+// Extract returns the value of the session cookie
+func (ct *CookieTransport) Extract(r *http.Request) (string, error) {
+	tokens, err := ct.extractAll(r)
+	if err != nil {
+		return "", err
+	}
+	return tokens[0], nil
+}
+
+func (ct *CookieTransport) extractAll(r *http.Request) ([]string, error) {
+	tokens, _, err := findSessionKeys(r.Cookies(), ct.Settings.Name, ct.AcceptLegacy)
+	return tokens, err
+}
+
+// Issue sets the session cookie, replacing any legacy cookie
+func (ct *CookieTransport) Issue(w http.ResponseWriter, r *http.Request, token string, ttl time.Duration) error {
+	if ct.AcceptLegacy {
+		if _, legacyCookie, err := findSessionKeys(r.Cookies(), ct.Settings.Name, true); err == nil && legacyCookie != nil {
+			http.SetCookie(w, removeSessionCookie(legacyCookie.Name, ct.Settings))
+		}
+	}
+	http.SetCookie(w, generateSessionCookie(ct.Settings.Name, token, ttl, ct.Settings.forRequest(r)))
+	return nil
+}
+
+// Legacy cookies predate workflows so only belong to the default workflow
+func (ct *CookieTransport) scope(workflow string) SessionTransport {
+	if workflow == "" {
+		return ct
+	}
+	settings := ct.Settings
+	settings.Name += "." + workflow
+	return &CookieTransport{settings, false}
+}
+
+// HeaderTransport carries the session token in a request header
+type HeaderTransport struct {
+	// The request header carrying the session token
+	Header string
+	// An optional authentication scheme preceding the token in the header,
+	// as in "Bearer <token>"
+	Scheme string
+	// The response header the token is issued in, Header if empty
+	ResponseHeader string
+}
+
+// Extract returns the session token in the request header
+func (ht *HeaderTransport) Extract(r *http.Request) (string, error) {
+	token := r.Header.Get(ht.Header)
+	if ht.Scheme != "" {
+		prefix := ht.Scheme + " "
+		if len(token) <= len(prefix) || !strings.EqualFold(token[:len(prefix)], prefix) {
+			return "", ErrNoSession
+		}
+		token = strings.TrimSpace(token[len(prefix):])
+	}
+	if token == "" {
+		return "", ErrNoSession
+	}
+	return token, nil
+}
+
+// Issue sets the session token in the response header
+func (ht *HeaderTransport) Issue(w http.ResponseWriter, r *http.Request, token string, ttl time.Duration) error {
+	header := ht.ResponseHeader
+	if header == "" {
+		header = ht.Header
+	}
+	w.Header().Set(header, token)
+	return nil
+}
+
+// QueryTransport carries the session token in a query parameter. The token is
+// issued in the SessionTokenHeader response header and is available from
+// Session.Token for building URLs.
+type QueryTransport struct {
+	Param string
+}
+
+// Extract returns the session token in the query parameter
+func (qt *QueryTransport) Extract(r *http.Request) (string, error) {
+	tokens, err := qt.extractAll(r)
+	if err != nil {
+		return "", err
+	}
+	return tokens[0], nil
+}
+
+func (qt *QueryTransport) extractAll(r *http.Request) ([]string, error) {
+	if r.URL == nil {
+		return nil, ErrNoSession
+	}
+	tokens := r.URL.Query()[qt.Param]
+	if len(tokens) == 0 || tokens[0] == "" {
+		return nil, ErrNoSession
+	}
+	return tokens, nil
+}
+
+// Issue sets the session token in the SessionTokenHeader response header
+func (qt *QueryTransport) Issue(w http.ResponseWriter, r *http.Request, token string, ttl time.Duration) error {
+	w.Header().Set(SessionTokenHeader, token)
+	return nil
+}
+
+// PathTransport carries the session token in the last segment of the URL's
+// path, as in "/next/<token>". The token is removed from the path of the
+// request passed to the session. It's issued in the SessionTokenHeader
+// response header and is available from Session.Token for building URLs.
+type PathTransport struct{}
+
+// Split the path into the path without the token and the token
+func splitTokenPath(path string) (string, string) {
+	i := strings.LastIndexByte(path, '/')
+	if i == -1 {
+		return path, ""
+	}
+	return path[:i], path[i+1:]
+}
+
+// Extract returns the last segment of the request's path
+func (pt *PathTransport) Extract(r *http.Request) (string, error) {
+	if r.URL == nil {
+		return "", ErrNoSession
+	}
+	_, token := splitTokenPath(r.URL.Path)
+	if token == "" {
+		return "", ErrNoSession
+	}
+	return token, nil
+}
+
+// Issue sets the session token in the SessionTokenHeader response header
+func (pt *PathTransport) Issue(w http.ResponseWriter, r *http.Request, token string, ttl time.Duration) error {
+	w.Header().Set(SessionTokenHeader, token)
+	return nil
+}
+
+// Remove the token from the request's path so the session sees the step's
+// path, as in "/next"
+func (pt *PathTransport) rewrite(r *http.Request) *http.Request {
+	path, _ := splitTokenPath(r.URL.Path)
+	rewritten := new(http.Request)
+	*rewritten = *r
+	rewritten.URL = new(url.URL)
+	*rewritten.URL = *r.URL
+	rewritten.URL.Path = path
+	rewritten.URL.RawPath = ""
+	return rewritten
+}
+
+// FallbackTransport combines several transports. Tokens are extracted from
+// the first transport whose request carries one and issued with all of them,
+// so for example browsers and API clients can share a Controller.
+type FallbackTransport []SessionTransport
+
+// Extract returns the token from the first transport that finds one
+func (ft FallbackTransport) Extract(r *http.Request) (string, error) {
+	tokens, err := ft.extractAll(r)
+	if err != nil {
+		return "", err
+	}
+	return tokens[0], nil
+}
+
+func (ft FallbackTransport) extractAll(r *http.Request) ([]string, error) {
+	err := ErrNoSession
+	for _, transport := range ft {
+		var tokens []string
+		tokens, err = extractAll(transport, r)
+		if err == nil {
+			return tokens, nil
+		}
+	}
+	return nil, err
+}
+
+// Issue issues the token with every transport, returning the first error
+func (ft FallbackTransport) Issue(w http.ResponseWriter, r *http.Request, token string, ttl time.Duration) error {
+	var firstErr error
+	for _, transport := range ft {
+		if err := transport.Issue(w, r, token, ttl); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (ft FallbackTransport) scope(workflow string) SessionTransport {
+	scoped := make(FallbackTransport, len(ft))
+	for i, transport := range ft {
+		scoped[i] = scopeTransport(transport, workflow)
+	}
+	return scoped
+}
+
+// Remove the token from the request's URL if it was carried there
+func (ft FallbackTransport) rewrite(r *http.Request) *http.Request {
+	for _, transport := range ft {
+		if _, err := transport.Extract(r); err == nil {
+			return rewriteRequest(transport, r)
+		}
+	}
+	return r
+}
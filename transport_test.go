@@ -0,0 +1,210 @@
+package statesman
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestHeaderTransport_ExtractsAndIssuesToken(t *testing.T) {
+	transport := &HeaderTransport{Header: "X-Session"}
+	r := &http.Request{Header: http.Header{"X-Session": {"token"}}}
+
+	token, err := transport.Extract(r)
+	if err != nil || token != "token" {
+		t.Fatalf("Expected the token got %v, %v\n", token, err)
+	}
+
+	w := httptest.NewRecorder()
+	transport.Issue(w, r, "issued", DefaultTimeout)
+	if w.Header().Get("X-Session") != "issued" {
+		t.Fatalf("Token wasn't issued in the header\n")
+	}
+}
+
+func TestHeaderTransport_RequiresScheme(t *testing.T) {
+	transport := &HeaderTransport{"Authorization", "Bearer", SessionTokenHeader}
+
+	r := &http.Request{Header: http.Header{"Authorization": {"bearer token"}}}
+	token, err := transport.Extract(r)
+	if err != nil || token != "token" {
+		t.Fatalf("Expected the token got %v, %v\n", token, err)
+	}
+
+	r = &http.Request{Header: http.Header{"Authorization": {"Basic token"}}}
+	if _, err := transport.Extract(r); err != ErrNoSession {
+		t.Fatalf("Expecting to get an error but didn't")
+	}
+}
+
+func TestQueryTransport_ExtractsToken(t *testing.T) {
+	transport := &QueryTransport{"session"}
+
+	r := &http.Request{URL: &url.URL{Path: "/next", RawQuery: "session=token"}}
+	token, err := transport.Extract(r)
+	if err != nil || token != "token" {
+		t.Fatalf("Expected the token got %v, %v\n", token, err)
+	}
+
+	r = &http.Request{URL: &url.URL{Path: "/next"}}
+	if _, err := transport.Extract(r); err != ErrNoSession {
+		t.Fatalf("Expecting to get an error but didn't")
+	}
+}
+
+func TestPathTransport_ExtractsAndRemovesToken(t *testing.T) {
+	transport := &PathTransport{}
+	r := &http.Request{URL: &url.URL{Path: "/next/token"}}
+
+	token, err := transport.Extract(r)
+	if err != nil || token != "token" {
+		t.Fatalf("Expected the token got %v, %v\n", token, err)
+	}
+
+	rewritten := transport.rewrite(r)
+	if rewritten.URL.Path != "/next" {
+		t.Fatalf("Expected the token to be removed from the path got %s\n", rewritten.URL.Path)
+	}
+	if r.URL.Path != "/next/token" {
+		t.Fatalf("Rewriting shouldn't modify the original request\n")
+	}
+}
+
+func TestCookieTransport_ScopesCookieByWorkflow(t *testing.T) {
+	transport := &CookieTransport{DefaultCookieSettings, true}
+
+	if scopeTransport(transport, "") != transport {
+		t.Fatalf("The default workflow should use the transport's cookie\n")
+	}
+	scoped := scopeTransport(transport, "checkout").(*CookieTransport)
+	if scoped.Settings.Name != DefaultCookieName+".checkout" || scoped.AcceptLegacy {
+		t.Fatalf("Workflow didn't get its own cookie %v\n", scoped.Settings)
+	}
+}
+
+func TestFallbackTransport_ExtractsFromFirstTransportWithToken(t *testing.T) {
+	transport := FallbackTransport{&HeaderTransport{Header: "X-Session"}, &PathTransport{}}
+	r := &http.Request{URL: &url.URL{Path: "/next/path"}, Header: http.Header{}}
+
+	token, err := transport.Extract(r)
+	if err != nil || token != "path" {
+		t.Fatalf("Expected the path token got %v, %v\n", token, err)
+	}
+	if rewriteRequest(transport, r).URL.Path != "/next" {
+		t.Fatalf("Expected the path token to be removed from the path\n")
+	}
+
+	r.Header.Set("X-Session", "header")
+	token, err = transport.Extract(r)
+	if err != nil || token != "header" {
+		t.Fatalf("Expected the header token got %v, %v\n", token, err)
+	}
+	if rewriteRequest(transport, r).URL.Path != "/next/path" {
+		t.Fatalf("The path shouldn't be rewritten for a header token\n")
+	}
+}
+
+func TestFallbackTransport_IssuesWithAllTransports(t *testing.T) {
+	transport := FallbackTransport{&HeaderTransport{Header: "X-Session"}, &CookieTransport{Settings: DefaultCookieSettings}}
+	w := httptest.NewRecorder()
+
+	transport.Issue(w, &http.Request{}, "token", DefaultTimeout)
+
+	if w.Header().Get("X-Session") != "token" || len(w.Header()["Set-Cookie"]) != 1 {
+		t.Fatalf("Token wasn't issued with all transports %v\n", w.Header())
+	}
+}
+
+// A transport that rejects every token with its own reason
+type rejectingTransport struct{}
+
+var errRejected = errors.New("Rejected.")
+
+func (rejectingTransport) Extract(r *http.Request) (string, error) {
+	return "", errRejected
+}
+
+func (rejectingTransport) Issue(w http.ResponseWriter, r *http.Request, token string, ttl time.Duration) error {
+	return nil
+}
+
+func TestSessionHandler_ReportsCustomTransportReason(t *testing.T) {
+	reasons := make(chan error, 1)
+	crl := newTestController(
+		WithTransport(rejectingTransport{}),
+		WithInvalidSessionHandler(func(w http.ResponseWriter, r *http.Request) {
+			reasons <- InvalidSessionReason(r)
+		}),
+	)
+
+	tc := newTestClient()
+	<-tc.get(crl.SessionHandler())
+
+	if reason := <-reasons; reason != errRejected {
+		t.Fatalf("Expected the transport's reason got %v\n", reason)
+	}
+}
+
+func getWithHeader(client *http.Client, url, header, value string) (string, string) {
+	req, err := http.NewRequest("GET", url, nil)
+	assertNoError(err)
+	if value != "" {
+		req.Header.Set(header, value)
+	}
+	res, err := client.Do(req)
+	assertNoError(err)
+	defer res.Body.Close()
+	bytes, err := ioutil.ReadAll(res.Body)
+	assertNoError(err)
+	return string(bytes), res.Header.Get(header)
+}
+
+func Test_executeSessionWithHeaderTransport(t *testing.T) {
+	sessionHandler := func(s *Session) {
+		w, _ := s.First()
+		fmt.Fprintf(w, "first")
+		w, _ = s.Next()
+		fmt.Fprintf(w, "next")
+	}
+	sc := newTestController(WithHeaderTransport("X-Session"))
+	mux := http.NewServeMux()
+	mux.HandleFunc("/first", sc.SessionStart(sessionHandler))
+	mux.HandleFunc("/next", sc.SessionHandler())
+	l, listenURL := listenAndServeBackground(mux)
+	defer (*l).Close()
+
+	// A client without a cookie jar
+	client := &http.Client{}
+	body, token := getWithHeader(client, listenURL+"/first", "X-Session", "")
+	if body != "first" || token == "" {
+		t.Fatalf("Expected the first response and a token got %s, %s\n", body, token)
+	}
+	body, _ = getWithHeader(client, listenURL+"/next", "X-Session", token)
+	if body != "next" {
+		t.Fatalf("Expected the next response got %s\n", body)
+	}
+}
+
+func Test_executeSessionWithPathTransport(t *testing.T) {
+	sessionHandler := func(s *Session) {
+		w, _ := s.First()
+		fmt.Fprintf(w, "/next/%s", s.Token())
+		w, r := s.Next()
+		fmt.Fprintf(w, "%s", r.URL.Path)
+	}
+	sc := newTestController(WithPathTransport())
+	mux := http.NewServeMux()
+	mux.HandleFunc("/first", sc.SessionStart(sessionHandler))
+	mux.HandleFunc("/next/", sc.SessionHandler())
+	l, listenURL := listenAndServeBackground(mux)
+	defer (*l).Close()
+
+	client := &http.Client{}
+	nextPath, _ := getWithHeader(client, listenURL+"/first", SessionTokenHeader, "")
+	getAndExpect(client, listenURL+nextPath, "/next", t)
+}
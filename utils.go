@@ -3,7 +3,6 @@ package statesman
 import (
 	"crypto/rand"
 	"encoding/hex"
-	"errors"
 	"net/http"
 	"strings"
 	"time"
@@ -19,22 +18,71 @@ func generateUniqueString(size int) string {
 	return hex.EncodeToString(b)
 }
 
-func generateSessionCookie(name string, value string, maxage time.Duration) *http.Cookie {
-	return &http.Cookie{
+// Generate a session cookie that expires after maxage unless the settings
+// override its lifetime
+func generateSessionCookie(name string, value string, maxage time.Duration, settings CookieSettings) *http.Cookie {
+	cookie := &http.Cookie{
 		Name:     name,
 		Value:    value,
-		Expires:  time.Now().Add(maxage),
-		Secure:   false,
-		HttpOnly: true,
+		Path:     settings.Path,
+		Domain:   settings.Domain,
+		Secure:   settings.Secure,
+		HttpOnly: settings.HttpOnly,
+		SameSite: settings.SameSite,
+	}
+	if settings.MaxAge < 0 {
+		return cookie
+	}
+	if settings.MaxAge > 0 {
+		maxage = settings.MaxAge
 	}
+	cookie.Expires = time.Now().Add(maxage)
+	cookie.MaxAge = int(maxage / time.Second)
+	return cookie
 }
 
-func findSessionCookie(cookies []*http.Cookie) (*http.Cookie, error) {
+// Generate a cookie that tells the browser to remove the named cookie
+func removeSessionCookie(name string, settings CookieSettings) *http.Cookie {
+	return &http.Cookie{
+		Name:   name,
+		Path:   settings.Path,
+		Domain: settings.Domain,
+		MaxAge: -1,
+	}
+}
+
+// Find a cookie in the legacy format where the session key is part of the
+// cookie's name
+func findLegacySessionCookie(cookies []*http.Cookie) (*http.Cookie, error) {
 	for _, c := range cookies {
 		if strings.HasPrefix(c.Name, statesmanPrefix) {
 			return c, nil
 		}
 	}
 
-	return nil, errors.New("Unable to find session key")
+	return nil, ErrNoSession
+}
+
+// Find the session keys in the values of the named cookies, falling back to
+// the legacy format if acceptLegacy is set. When the legacy format is used
+// its cookie is also returned so that it can be replaced.
+func findSessionKeys(cookies []*http.Cookie, name string, acceptLegacy bool) ([]string, *http.Cookie, error) {
+	var sessionKeys []string
+	for _, c := range cookies {
+		if c.Name == name && c.Value != "" {
+			sessionKeys = append(sessionKeys, c.Value)
+		}
+	}
+	if len(sessionKeys) != 0 {
+		return sessionKeys, nil, nil
+	}
+	if !acceptLegacy {
+		return nil, nil, ErrNoSession
+	}
+
+	cookie, err := findLegacySessionCookie(cookies)
+	if err != nil {
+		return nil, nil, err
+	}
+	return []string{strings.TrimPrefix(cookie.Name, statesmanPrefix)}, cookie, nil
 }
@@ -22,29 +22,102 @@ func TestGenerateUniqueString_returnsUniqueString(t *testing.T) {
 }
 
 func TestGenerateSessionCookie_ReturnsCookie(t *testing.T) {
-	cookie := generateSessionCookie("name", "value", 10*time.Second)
+	cookie := generateSessionCookie("name", "value", 10*time.Second, DefaultCookieSettings)
 
 	if cookie == nil {
 		t.Fatalf("Didn't get the expected cookie\n")
 	}
 }
 
-func TestFindSessionCookie_findsMatchingCookie(t *testing.T) {
+func TestGenerateSessionCookie_AppliesSettings(t *testing.T) {
+	settings := CookieSettings{
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+		Path:     "/checkout",
+		Domain:   "example.com",
+	}
+	cookie := generateSessionCookie("name", "value", 10*time.Second, settings)
+
+	if !cookie.Secure || !cookie.HttpOnly || cookie.SameSite != http.SameSiteStrictMode ||
+		cookie.Path != "/checkout" || cookie.Domain != "example.com" {
+		t.Fatalf("Cookie didn't get the expected settings %v\n", cookie)
+	}
+	if cookie.MaxAge != 10 {
+		t.Fatalf("Expected a MaxAge of 10 got %d\n", cookie.MaxAge)
+	}
+}
+
+func TestGenerateSessionCookie_MaxAgeOverridesTimeout(t *testing.T) {
+	cookie := generateSessionCookie("name", "value", 10*time.Second, CookieSettings{MaxAge: time.Minute})
+
+	if cookie.MaxAge != 60 {
+		t.Fatalf("Expected a MaxAge of 60 got %d\n", cookie.MaxAge)
+	}
+}
+
+func TestGenerateSessionCookie_NegativeMaxAgeMakesSessionCookie(t *testing.T) {
+	cookie := generateSessionCookie("name", "value", 10*time.Second, CookieSettings{MaxAge: -1})
+
+	if cookie.MaxAge != 0 || !cookie.Expires.IsZero() {
+		t.Fatalf("Expected a browser session cookie got %v\n", cookie)
+	}
+}
+
+func TestFindSessionKeys_findsMatchingCookies(t *testing.T) {
+	nonMatchingCookie := &http.Cookie{Name: "non matching stuff", Value: "other"}
+	matchingCookie0 := &http.Cookie{Name: DefaultCookieName, Value: "stuff0"}
+	matchingCookie1 := &http.Cookie{Name: DefaultCookieName, Value: "stuff1"}
+
+	keys, _, _ := findSessionKeys([]*http.Cookie{matchingCookie0, nonMatchingCookie, matchingCookie1}, DefaultCookieName, false)
+
+	if len(keys) != 2 || keys[0] != "stuff0" || keys[1] != "stuff1" {
+		t.Fatalf("Expecting to find the matching cookies but got %v", keys)
+	}
+}
+
+func TestFindSessionKeys_returnsErrorIfNoMatchingCookie(t *testing.T) {
+	nonMatchingCookie := &http.Cookie{Name: "non matching stuff"}
+
+	_, _, err := findSessionKeys([]*http.Cookie{nonMatchingCookie}, DefaultCookieName, true)
+
+	if err == nil {
+		t.Fatalf("Expecting to get an error but didn't")
+	}
+}
+
+func TestFindLegacySessionCookie_findsMatchingCookie(t *testing.T) {
 	nonMatchingCookie := &http.Cookie{Name: "non matching stuff"}
 	matchingCookie := &http.Cookie{Name: statesmanPrefix + "stuff"}
 
-	c, _ := findSessionCookie([]*http.Cookie{nonMatchingCookie, matchingCookie})
+	c, _ := findLegacySessionCookie([]*http.Cookie{nonMatchingCookie, matchingCookie})
 
 	if c != matchingCookie {
 		t.Fatalf("Expecting to find a matching cookie but didn't")
 	}
 }
 
-func TestFindSessionCookie_returnsErrorIfNoMatchingCookie(t *testing.T) {
-	nonMatchingCookie := &http.Cookie{Name: "non matching stuff"}
+func TestFindSessionKeys_prefersCurrentFormat(t *testing.T) {
+	legacyCookie := &http.Cookie{Name: statesmanPrefix + "legacy"}
+	cookie := &http.Cookie{Name: DefaultCookieName, Value: "current"}
+
+	keys, legacy, _ := findSessionKeys([]*http.Cookie{legacyCookie, cookie}, DefaultCookieName, true)
+
+	if len(keys) != 1 || keys[0] != "current" || legacy != nil {
+		t.Fatalf("Expecting the current session key got %v\n", keys)
+	}
+}
+
+func TestFindSessionKeys_fallsBackToLegacyFormat(t *testing.T) {
+	legacyCookie := &http.Cookie{Name: statesmanPrefix + "legacy"}
 
-	_, err := findSessionCookie([]*http.Cookie{nonMatchingCookie})
+	keys, legacy, _ := findSessionKeys([]*http.Cookie{legacyCookie}, DefaultCookieName, true)
+
+	if len(keys) != 1 || keys[0] != "legacy" || legacy != legacyCookie {
+		t.Fatalf("Expecting the legacy session key got %v\n", keys)
+	}
 
+	_, _, err := findSessionKeys([]*http.Cookie{legacyCookie}, DefaultCookieName, false)
 	if err == nil {
 		t.Fatalf("Expecting to get an error but didn't")
 	}
@@ -0,0 +1,352 @@
+package statesman
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+)
+
+// Workflow is a named session function. Each workflow tracks its sessions with
+// its own cookie so that a client can take part in several workflows of the
+// same Controller at once.
+type Workflow struct {
+	controller *Controller
+	// The name of the workflow, empty for the Controller's default workflow
+	name           string
+	sessionHandler func(s *Session)
+	// Where the workflow is mounted when it's used as an http.Handler
+	prefix    string
+	startPath string
+	// The known step paths relative to the prefix, nil to route every path
+	steps []string
+	// What happens to requests from the pages of past steps
+	pastSteps PastStepPolicy
+}
+
+// NewWorkflow creates a workflow that runs sessionHandler for each session.
+// When session tokens are carried in cookies its sessions are tracked with a
+// cookie named after the Controller's cookie and the workflow's name, so an
+// error is returned if the Controller already has a workflow with the name.
+// The options configure how the workflow routes requests when it's used as an
+// http.Handler.
+func (clr *Controller) NewWorkflow(name string, sessionHandler func(s *Session), opts ...WorkflowOption) (*Workflow, error) {
+	if clr.isClosed() {
+		return nil, ErrControllerClosed
+	}
+	if name == "" || !isValidCookieName(name) {
+		return nil, fmt.Errorf("Invalid workflow name \"%s\".", name)
+	}
+	if sessionHandler == nil {
+		return nil, errors.New("Missing session handler.")
+	}
+	wf := clr.workflow(name, sessionHandler)
+	for _, opt := range opts {
+		if err := opt(wf); err != nil {
+			return nil, err
+		}
+	}
+	if err := clr.claimWorkflow(name); err != nil {
+		return nil, err
+	}
+	return wf, nil
+}
+
+// Name returns the name of the workflow
+func (wf *Workflow) Name() string {
+	return wf.name
+}
+
+// Wrap the response writer of a request passed to the session, recording the
+// response if it may be replayed
+func (wf *Workflow) responseWriter(w http.ResponseWriter) *responseWriter {
+	writer := newResponseWriter(w)
+	if wf.pastSteps == ReplayPastSteps || wf.controller.options.IdempotentReplay {
+		writer.record()
+	}
+	return writer
+}
+
+// The transport that carries the workflow's session tokens
+func (wf *Workflow) transport() SessionTransport {
+	return scopeTransport(wf.controller.transport, wf.name)
+}
+
+// SessionStart returns a handler function that starts a new session of the
+// workflow. The Session.First() method can be called to get the
+// http.ResponseWriter and http.Request. The returned handler function can be
+// used with http.HandleFunc
+func (wf *Workflow) SessionStart() func(w http.ResponseWriter, r *http.Request) {
+	clr := wf.controller
+	sessionInitializer := func(w http.ResponseWriter, r *http.Request) {
+
+		if ok, retryAfter := clr.startLimiter.allow(); !ok {
+			clr.rateLimited(w, r, retryAfter)
+			return
+		}
+
+		// Create a session and register it with the session controller
+		sessionKey := generateUniqueString(32)
+		session := newSession(clr, sessionKey)
+		session.workflow = wf.name
+		session.keepHistory = wf.pastSteps != ContinuePastSteps
+		session.fingerprint = clr.options.Binding.fingerprint(r)
+		if clr.options.MaxSessionsPerClient != 0 {
+			session.client = clr.clientKey(r)
+		}
+
+		// Register the session with the controller, which fails if it's
+		// shutting down or closed, or there are too many sessions
+		if err := clr.register(sessionKey, session); err != nil {
+			if err == ErrTooManySessions || err == ErrTooManyClientSessions {
+				clr.sessionLimited(w, r, err)
+				return
+			}
+			clr.options.UnavailableHandler(w, r)
+			return
+		}
+
+		// Issue the session token before passing the response onto the
+		// session to avoid a race condition with the session goroutine
+		token := clr.tokens.encode(sessionKey)
+		if err := wf.transport().Issue(w, r, token, clr.options.SessionTimeout); err != nil {
+			clr.unregister(sessionKey)
+			clr.options.ErrorHandler(w, r)
+			return
+		}
+
+		go func() {
+			defer func() {
+				if value := recover(); value != nil {
+					clr.recoverSession(session, value, debug.Stack())
+				}
+
+				// Fail requests that are sent to the session from now on,
+				// before it's unregistered
+				session.end(ErrSessionFinished)
+
+				// The request has been serviced so allow the previous handler
+				// function to finish
+				session.unblockHandler()
+
+				// Unregister the session from the controller
+				clr.unregister(sessionKey)
+			}()
+
+			wf.sessionHandler(session)
+		}()
+
+		// The initial request is admitted before anyone else has the token
+		session.slot <- struct{}{}
+		defer session.release()
+
+		// Send the initial request to the session (received via First()).
+		// The session function may return without calling First
+		request := newHTTPRequest(wf.responseWriter(w), r, token, clr.csrfToken())
+		select {
+		case session.httpRequestCh <- request:
+		case <-session.done:
+			clr.sessionEnded(w, r, session)
+			return
+		}
+
+		// Wait for the session to handle the request before returning from this HandleFunc
+		session.blockHandler(request)
+	}
+
+	return sessionInitializer
+}
+
+// Find the workflow's session for the request. A client may send several
+// tokens, such as cookies with the workflow's name for different paths, so
+// each is tried in turn. If no session is found the error is the reason why.
+func (wf *Workflow) findSession(r *http.Request) (*Session, string, error) {
+	clr := wf.controller
+	tokens, err := extractAll(wf.transport(), r)
+	if err != nil {
+		return nil, "", err
+	}
+
+	reason := ErrUnknownSession
+	for _, token := range tokens {
+		sessionKey, err := clr.tokens.decode(token)
+		if err != nil {
+			reason = err
+			continue
+		}
+		session, err := clr.session(sessionKey)
+		if err == ErrSessionKeyRetired {
+			reason = err
+			continue
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		if session != nil && session.workflow == wf.name {
+			return session, sessionKey, nil
+		}
+		if reason != ErrSessionKeyRetired {
+			reason = ErrUnknownSession
+		}
+	}
+	return nil, "", reason
+}
+
+// Replay the last response of the session if the request is a duplicate of
+// the request it answered, with the session token issued in it. It returns
+// whether the response was replayed.
+func (wf *Workflow) replayDuplicate(w http.ResponseWriter, r *http.Request, session *Session) bool {
+	clr := wf.controller
+	if !clr.options.IdempotentReplay {
+		return false
+	}
+	last := session.duplicateOf(r)
+	if last == nil {
+		return false
+	}
+	err := last.response.replay(w, func() error {
+		return wf.transport().Issue(w, r, last.token, clr.options.SessionTimeout)
+	})
+	if err != nil {
+		clr.options.ErrorHandler(w, r)
+	}
+	return true
+}
+
+// SessionHandler returns a handler function to process within the workflow's
+// sessions. The Session.Next() method can be called to get the
+// http.ResponseWriter and http.Request. The returned handler function can be
+// used with http.HandleFunc
+func (wf *Workflow) SessionHandler() func(w http.ResponseWriter, r *http.Request) {
+	clr := wf.controller
+	nextHandler := func(w http.ResponseWriter, r *http.Request) {
+		if clr.isClosed() {
+			clr.options.UnavailableHandler(w, r)
+			return
+		}
+
+		session, sessionKey, err := wf.findSession(r)
+		if err == ErrControllerClosed {
+			clr.options.UnavailableHandler(w, r)
+			return
+		}
+
+		// Session token is missing or invalid, or the session doesn't exist
+		// or has already exited
+		if err != nil {
+			clr.invalidSession(w, r, err)
+			return
+		}
+
+		// The request may be from a client that obtained the session token
+		// of another
+		if clr.options.Binding.fingerprint(r) != session.fingerprint {
+			clr.invalidSession(w, r, ErrSessionBindingMismatch)
+			return
+		}
+
+		if ok, retryAfter := session.limiter.allow(); !ok {
+			clr.rateLimited(w, r, retryAfter)
+			return
+		}
+
+		// Wait for, reject or supersede a request the session is already
+		// handling
+		original := r
+		r, release, err := session.admit(r, clr.options.Concurrency)
+		if err != nil {
+			clr.notAdmitted(w, original, err)
+			return
+		}
+		defer release()
+
+		// A retry of the request the session has just handled gets the same
+		// response, rather than being taken as a request from a past step.
+		// It's checked once admitted so that the session has finished
+		// handling the original.
+		if wf.replayDuplicate(w, r, session) {
+			return
+		}
+
+		// A request from the page of a past step, such as after using the
+		// back button, is handled by the workflow's policy. It's decided
+		// once admitted so that the history can't change before the session
+		// receives the request.
+		var past pastStep
+		if wf.pastSteps != ContinuePastSteps {
+			past = session.pastStep(r, wf.pastSteps)
+			if past.response != nil {
+				err := past.response.replay(w, func() error {
+					return wf.transport().Issue(w, r, clr.tokens.encode(sessionKey), clr.options.SessionTimeout)
+				})
+				if err != nil {
+					clr.options.ErrorHandler(w, r)
+				}
+				return
+			}
+			if past.rejected {
+				session.outOfSequence(w, r, nil)
+				return
+			}
+		}
+
+		// A state changing request must carry the CSRF token of the
+		// session's current step, or of the step it rewinds
+		if clr.options.CSRFProtection {
+			verified := session.verifyCSRF(r)
+			if past.rewind {
+				verified = verifyCSRFToken(r, past.csrfToken)
+			}
+			if !verified {
+				clr.options.CSRFFailureHandler(w, r)
+				return
+			}
+		}
+
+		// Replace a key that may have leaked, such as in a log, so that it
+		// can't be used to hijack or replay the session
+		if clr.options.RotateKeys {
+			sessionKey, err = clr.rotate(sessionKey)
+			if err == ErrControllerClosed {
+				clr.options.UnavailableHandler(w, r)
+				return
+			}
+			if err != nil {
+				clr.invalidSession(w, r, err)
+				return
+			}
+		}
+
+		// Issue the session token before passing the response onto the
+		// session to avoid a race condition with the session goroutine
+		token := clr.tokens.encode(sessionKey)
+		transport := wf.transport()
+		if err := transport.Issue(w, r, token, clr.options.SessionTimeout); err != nil {
+			clr.options.ErrorHandler(w, r)
+			return
+		}
+		r = rewriteRequest(transport, r)
+
+		// Send this request to the session (received via Next(). The session
+		// may expire before it receives the request.
+		request := newHTTPRequest(wf.responseWriter(w), r, token, clr.csrfToken())
+		request.disconnected = original.Context().Done()
+		request.rewind, request.rewindTo = past.rewind, past.rewindTo
+		request.method, request.path = original.Method, original.URL.Path
+		request.stepToken = requestStepToken(original)
+		request.idempotencyKey = original.Header.Get(IdempotencyKeyHeader)
+		select {
+		case session.httpRequestCh <- request:
+		case <-session.done:
+			clr.sessionEnded(w, r, session)
+			return
+		case <-r.Context().Done():
+			clr.notAdmitted(w, original, errConcurrentRequest)
+			return
+		}
+
+		// Block this handler until the session has serviced the current request
+		session.blockHandler(request)
+	}
+	return nextHandler
+}
@@ -0,0 +1,103 @@
+package statesman
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestNewWorkflow_RejectsInvalidNames(t *testing.T) {
+	crl := newTestController()
+	for _, name := range []string{"", "bad name", "bad;name"} {
+		if _, err := crl.NewWorkflow(name, func(*Session) {}); err == nil {
+			t.Fatalf("NewWorkflow should have rejected \"%s\"\n", name)
+		}
+	}
+}
+
+func TestNewWorkflow_RejectsDuplicateNames(t *testing.T) {
+	crl := newTestController()
+	defer crl.Close()
+	if _, err := crl.NewWorkflow("checkout", func(*Session) {}); err != nil {
+		t.Fatalf("NewWorkflow shouldn't have returned an err %v\n", err)
+	}
+	if _, err := crl.NewWorkflow("checkout", func(*Session) {}); err == nil {
+		t.Fatalf("NewWorkflow should have rejected a duplicate name\n")
+	}
+}
+
+func TestNewWorkflow_RejectsNilSessionHandler(t *testing.T) {
+	crl := newTestController()
+	defer crl.Close()
+	if _, err := crl.NewWorkflow("checkout", nil); err == nil {
+		t.Fatalf("NewWorkflow should have rejected a nil session handler\n")
+	}
+}
+
+func TestNewWorkflow_ReturnsErrorIfClosed(t *testing.T) {
+	crl := newTestController()
+	crl.Close()
+	if _, err := crl.NewWorkflow("name", func(*Session) {}); err != ErrControllerClosed {
+		t.Fatalf("Expected ErrControllerClosed got %v\n", err)
+	}
+}
+
+func TestWorkflow_UsesItsOwnCookie(t *testing.T) {
+	crl := newTestController()
+	wf, _ := crl.NewWorkflow("checkout", func(s *Session) { s.First() })
+
+	tc := newTestClient()
+	<-tc.get(wf.SessionStart())
+
+	cookies := (&http.Response{Header: tc.w.Header()}).Cookies()
+	if len(cookies) != 1 || cookies[0].Name != DefaultCookieName+".checkout" {
+		t.Fatalf("Workflow didn't set its own cookie got %v\n", cookies)
+	}
+}
+
+func TestWorkflow_SessionHandlerIgnoresOtherWorkflows(t *testing.T) {
+	crl := newTestController()
+	wf, _ := crl.NewWorkflow("checkout", func(s *Session) {
+		s.First()
+		s.Next()
+	})
+
+	tc := newTestClient()
+	<-tc.get(wf.SessionStart())
+	<-tc.get(crl.SessionHandler())
+
+	if tc.w.status != http.StatusForbidden {
+		t.Fatalf("Default workflow shouldn't accept another workflow's session\n")
+	}
+}
+
+func Test_executeConcurrentWorkflowsWithOneClient(t *testing.T) {
+	workflowHandler := func(name string) func(s *Session) {
+		return func(s *Session) {
+			w, _ := s.First()
+			fmt.Fprintf(w, "%s start", name)
+			w, _ = s.Next()
+			fmt.Fprintf(w, "%s finish", name)
+		}
+	}
+	// Send both workflows' cookies with every request
+	settings := DefaultCookieSettings
+	settings.Path = "/"
+	sc := newTestController(WithCookieSettings(settings))
+	checkout, _ := sc.NewWorkflow("checkout", workflowHandler("checkout"))
+	support, _ := sc.NewWorkflow("support", workflowHandler("support"))
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/checkout/start", checkout.SessionStart())
+	mux.HandleFunc("/checkout/finish", checkout.SessionHandler())
+	mux.HandleFunc("/support/start", support.SessionStart())
+	mux.HandleFunc("/support/finish", support.SessionHandler())
+	l, listenURL := listenAndServeBackground(mux)
+	defer (*l).Close()
+
+	client := newClient()
+	getAndExpect(client, listenURL+"/checkout/start", "checkout start", t)
+	getAndExpect(client, listenURL+"/support/start", "support start", t)
+	getAndExpect(client, listenURL+"/checkout/finish", "checkout finish", t)
+	getAndExpect(client, listenURL+"/support/finish", "support finish", t)
+}
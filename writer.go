@@ -0,0 +1,93 @@
+package statesman
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"sync"
+)
+
+// ErrClientDisconnected is returned by Session.RequestErr once the client of
+// the current request has gone away, and by writes to its
+// http.ResponseWriter.
+var ErrClientDisconnected = errors.New("Client disconnected.")
+
+// responseWriter is the http.ResponseWriter passed to sessions. Its HandleFunc
+// returns as soon as the client disconnects, after which net/http no longer
+// allows the response to be written, so the writer is detached and discards
+// anything the session writes.
+type responseWriter struct {
+	mutex    sync.Mutex
+	w        http.ResponseWriter
+	detached bool
+	// The headers written once detached
+	header http.Header
+	// Whether the response is recorded for replaying
+	recording bool
+	status    int
+	body      bytes.Buffer
+}
+
+func newResponseWriter(w http.ResponseWriter) *responseWriter {
+	return &responseWriter{w: w}
+}
+
+// Header returns the response's headers
+func (rw *responseWriter) Header() http.Header {
+	rw.mutex.Lock()
+	defer rw.mutex.Unlock()
+	if rw.detached {
+		if rw.header == nil {
+			rw.header = http.Header{}
+		}
+		return rw.header
+	}
+	return rw.w.Header()
+}
+
+// Write writes the response's body, returning ErrClientDisconnected once the
+// client has gone away
+func (rw *responseWriter) Write(b []byte) (int, error) {
+	rw.mutex.Lock()
+	defer rw.mutex.Unlock()
+	if rw.detached {
+		return 0, ErrClientDisconnected
+	}
+	if rw.recording {
+		rw.body.Write(b)
+	}
+	return rw.w.Write(b)
+}
+
+// WriteHeader writes the response's status code
+func (rw *responseWriter) WriteHeader(status int) {
+	rw.mutex.Lock()
+	defer rw.mutex.Unlock()
+	if !rw.detached {
+		rw.status = status
+		rw.w.WriteHeader(status)
+	}
+}
+
+// Flush sends any buffered data to the client if the underlying
+// http.ResponseWriter supports it
+func (rw *responseWriter) Flush() {
+	rw.mutex.Lock()
+	defer rw.mutex.Unlock()
+	if flusher, ok := rw.w.(http.Flusher); ok && !rw.detached {
+		flusher.Flush()
+	}
+}
+
+// Unwrap returns the underlying http.ResponseWriter
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.w
+}
+
+// Stop passing writes to the underlying http.ResponseWriter, waiting for any
+// write in progress to finish
+func (rw *responseWriter) detach() {
+	rw.mutex.Lock()
+	rw.detached = true
+	rw.mutex.Unlock()
+}
@@ -0,0 +1,104 @@
+package statesman
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+func TestResponseWriter_PassesWritesThrough(t *testing.T) {
+	w := &testResponseWriter{}
+	rw := newResponseWriter(w)
+
+	rw.Header().Set("X-Test", "value")
+	rw.WriteHeader(http.StatusAccepted)
+	if _, err := rw.Write([]byte("body")); err != nil {
+		t.Fatalf("Unexpected error %v\n", err)
+	}
+
+	if w.status != http.StatusAccepted || w.Header().Get("X-Test") != "value" {
+		t.Fatalf("Writes weren't passed through %d %v\n", w.status, w.Header())
+	}
+	if rw.Unwrap() != w {
+		t.Fatalf("Expected the underlying ResponseWriter\n")
+	}
+}
+
+func TestResponseWriter_DiscardsWritesOnceDetached(t *testing.T) {
+	w := &testResponseWriter{}
+	rw := newResponseWriter(w)
+	rw.detach()
+
+	rw.Header().Set("X-Test", "value")
+	rw.WriteHeader(http.StatusAccepted)
+	if _, err := rw.Write([]byte("body")); err != ErrClientDisconnected {
+		t.Fatalf("Expected %v got %v\n", ErrClientDisconnected, err)
+	}
+
+	if w.status != 0 || w.Header().Get("X-Test") != "" {
+		t.Fatalf("Writes weren't discarded %d %v\n", w.status, w.Header())
+	}
+}
+
+func TestSessionHandler_ReturnsWhenClientDisconnects(t *testing.T) {
+	crl := newTestController()
+	defer crl.Close()
+	received := make(chan bool)
+	disconnected := make(chan bool)
+	stepErrs := make(chan error, 3)
+	tokens := make(chan string, 1)
+	firstHandler := crl.SessionStart(func(s *Session) {
+		s.First()
+		tokens <- s.Token()
+
+		w, _ := s.Next()
+		received <- true
+		<-s.RequestDone()
+		stepErrs <- s.RequestErr()
+		<-disconnected
+		_, err := w.Write([]byte("too late"))
+		stepErrs <- err
+
+		// Carry on with the client's retry
+		w, _ = s.Next()
+		stepErrs <- s.RequestErr()
+		w.WriteHeader(http.StatusOK)
+	})
+	tc := newTestClient()
+	firstHandler(tc.w, tc.r)
+	token := <-tokens
+
+	ctx, cancel := context.WithCancel(context.Background())
+	tc = newTestClient()
+	tc.r = tc.r.WithContext(ctx)
+	tc.r.AddCookie(&http.Cookie{Name: DefaultCookieName, Value: token})
+	done := make(chan bool)
+	go func() {
+		crl.SessionHandler()(tc.w, tc.r)
+		done <- true
+	}()
+	<-received
+	cancel()
+	<-done
+	disconnected <- true
+
+	if err := <-stepErrs; err != ErrClientDisconnected {
+		t.Fatalf("Expected %v got %v\n", ErrClientDisconnected, err)
+	}
+	if err := <-stepErrs; err != ErrClientDisconnected {
+		t.Fatalf("Expected writes to fail with %v got %v\n", ErrClientDisconnected, err)
+	}
+	if tc.w.status != 0 {
+		t.Fatalf("The disconnected response shouldn't have been written\n")
+	}
+
+	retry := newTestClient()
+	retry.r.AddCookie(&http.Cookie{Name: DefaultCookieName, Value: token})
+	crl.SessionHandler()(retry.w, retry.r)
+	if err := <-stepErrs; err != nil {
+		t.Fatalf("Unexpected error %v\n", err)
+	}
+	if retry.w.status != http.StatusOK {
+		t.Fatalf("Expected the retry to be handled got %d\n", retry.w.status)
+	}
+}